@@ -3,57 +3,49 @@ package accounting
 import (
 	"database/sql"
 	"fmt"
-	"sync"
+	"strings"
 
 	"github.com/cheggaaa/pb"
 	"github.com/golang/glog"
 
 	h "github.com/microcosm-cc/microcosm/helpers"
-)
 
-// Tracks imported items
-// The structure of these is all:
-//   item[oldid] = newid
-// Absence from this means that the item has not been imported
-var (
-	attachments       = make(map[int64]int64)
-	attachmentsLock   sync.RWMutex
-	conversations     = make(map[int64]int64)
-	conversationsLock sync.RWMutex
-	comments          = make(map[int64]int64)
-	commentsLock      sync.RWMutex
-	huddles           = make(map[int64]int64)
-	huddlesLock       sync.RWMutex
-	microcosms        = make(map[int64]int64)
-	microcosmsLock    sync.RWMutex
-
-	// Note that this actually looks up old userIDs and returns profileIDs
-	profiles     = make(map[int64]int64)
-	profilesLock sync.RWMutex
-
-	roles        = make(map[int64]int64)
-	rolesLock    sync.RWMutex
-	watchers     = make(map[int64]int64)
-	watchersLock sync.RWMutex
+	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/registry"
 )
 
 // CreateImportOrigin records in Postgres that we are about to start an import
 // and the summary info of which site was the source of this
-func CreateImportOrigin(tx *sql.Tx, title string, siteID int64) (int64, error) {
+func CreateImportOrigin(
+	tx *sql.Tx,
+	title string,
+	siteID int64,
+	manifest files.Manifest,
+) (
+	int64,
+	error,
+) {
 
 	var originID int64
 
-	// TODO: Today this just presumes that we are a vBulletin 3.8 series forum
-	// but in the future we need to make this accept whatever the exported data
-	// tells us.
+	// Exports that pre-date the manifest do not say when they were made
+	var exported interface{}
+	if !manifest.Exported.IsZero() {
+		exported = manifest.Exported
+	}
+
 	err := tx.QueryRow(`
 INSERT INTO import_origins (
-	title, site_id, product, major_version, minor_version
+	title, site_id, product, major_version, minor_version, exported
 ) VALUES (
-	$1, $2, 'vbulletin', 3, 8
+	$1, $2, $3, $4, $5, $6
 ) RETURNING origin_id`,
 		title,
 		siteID,
+		manifest.Product,
+		manifest.MajorVersion,
+		manifest.MinorVersion,
+		exported,
 	).Scan(
 		&originID,
 	)
@@ -61,6 +53,8 @@ INSERT INTO import_origins (
 		return originID, err
 	}
 
+	newDiskOrigin(originID)
+
 	return originID, nil
 }
 
@@ -96,43 +90,126 @@ func ImportedFollows(originID int64) {
 	)
 }
 
-func ThreadComments(originID int64) bool {
+// SetCommentsThreaded records whether every comment of the import origin that
+// is a reply has been threaded
+func SetCommentsThreaded(originID int64, threaded bool) {
 	db, err := h.GetConnection()
 	if err != nil {
-		return false
+		return
 	}
 
-	var threadComments bool
+	db.Exec(`UPDATE import_origins
+   SET imported_comments_threaded = $2
+ WHERE origin_id = $1`,
+		originID,
+		threaded,
+	)
+}
+
+// GetImportFlags returns whether the follows have been imported and the comments
+// threaded for the given import origin
+func GetImportFlags(originID int64) (
+	importedFollows bool,
+	threadedComments bool,
+	err error,
+) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return
+	}
 
-	db.QueryRow(`SELECT imported_comments_threaded
+	err = db.QueryRow(`SELECT imported_follows
+      ,imported_comments_threaded
   FROM import_origins
  WHERE origin_id = $1`,
 		originID,
 	).Scan(
-		&threadComments,
+		&importedFollows,
+		&threadedComments,
 	)
 
-	return !threadComments
+	return
 }
 
-func ThreadedComments(originID int64) {
+// CountImportedItems returns the number of items of each item type recorded in
+// imported_items for the given import origin, keyed by item type ID
+func CountImportedItems(originID int64) (map[int64]int64, error) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+SELECT item_type_id
+      ,COUNT(*)
+  FROM imported_items
+ WHERE origin_id = $1
+ GROUP BY item_type_id`,
+		originID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int64)
+	for rows.Next() {
+		var itemTypeID, count int64
+		err = rows.Scan(
+			&itemTypeID,
+			&count,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[itemTypeID] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return counts, nil
+}
 
+// GetOtherOrigin returns the ID of an import origin other than the given one
+// that has imported the item, or 0 if no other origin has
+func GetOtherOrigin(originID int64, itemTypeID int64, itemID int64) (int64, error) {
 	db, err := h.GetConnection()
 	if err != nil {
-		return
+		return 0, err
 	}
 
-	db.Exec(`UPDATE import_origins
-   SET imported_comments_threaded = TRUE
- WHERE origin_id = $1`,
+	var otherOriginID int64
+	err = db.QueryRow(`
+SELECT origin_id
+  FROM imported_items
+ WHERE item_type_id = $1
+   AND item_id = $2
+   AND origin_id <> $3
+ LIMIT 1`,
+		itemTypeID,
+		itemID,
 		originID,
+	).Scan(
+		&otherOriginID,
 	)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return otherOriginID, err
 }
 
 // RecordImport records a successful import of any item, this represents
 // internally a map of identifiers from the source system to identifiers within
 // Microcosm.
 // i.e. we'd know that vBulletin Thread 321 == Microcosm Conversation 45984
+//
+// The maps of old to new IDs are not updated, as the transaction may yet fail
+// to commit. RecordImportInMemory must be called once it has been committed.
 func RecordImport(
 	tx *sql.Tx,
 	originID int64,
@@ -157,7 +234,20 @@ INSERT into imported_items (
 		return err
 	}
 
-	updateStateMap(itemTypeID, oldID, itemID)
+	// The item is no longer an orphan should the import be interrupted
+	_, err = tx.Exec(`
+DELETE FROM import_intents
+ WHERE origin_id = $1
+   AND item_type_id = $2
+   AND old_id = $3`,
+		originID,
+		itemTypeID,
+		oldID,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
 	return nil
 }
@@ -166,134 +256,75 @@ INSERT into imported_items (
 // profiles, helping to ensure that when 0 is looked up it will return the new
 // ID. We cannot do thise via RecordImport as PostgreSQL views the zero value as
 // breaking the integrity of the database.
-func AddDeletedProfileID(profileID int64) {
-	updateStateMap(h.ItemTypes[h.ItemTypeProfile], 0, profileID)
+func AddDeletedProfileID(originID int64, profileID int64) {
+	err := updateStateMap(originID, h.ItemTypes[h.ItemTypeProfile], 0, profileID)
+	if err != nil {
+		glog.Error(err)
+	}
 }
 
-func updateStateMap(
+// RecordImportInMemory records the import of an item without touching the
+// database, for imports such as dry runs that do not write to the database and
+// for imports recorded by RecordImport once the transaction has committed.
+func RecordImportInMemory(
+	originID int64,
 	itemTypeID int64,
 	oldID int64,
-	newID int64,
-) {
-
-	switch itemTypeID {
-	case h.ItemTypes[h.ItemTypeMicrocosm]:
-		microcosmsLock.Lock()
-		microcosms[oldID] = newID
-		microcosmsLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeProfile]:
-		profilesLock.Lock()
-		profiles[oldID] = newID
-		profilesLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeConversation]:
-		conversationsLock.Lock()
-		conversations[oldID] = newID
-		conversationsLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeComment]:
-		commentsLock.Lock()
-		comments[oldID] = newID
-		commentsLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeRole]:
-		rolesLock.Lock()
-		roles[oldID] = newID
-		rolesLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeWatcher]:
-		watchersLock.Lock()
-		watchers[oldID] = newID
-		watchersLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeHuddle]:
-		huddlesLock.Lock()
-		huddles[oldID] = newID
-		huddlesLock.Unlock()
-
-	case h.ItemTypes[h.ItemTypeAttachment]:
-		attachmentsLock.Lock()
-		attachments[oldID] = newID
-		attachmentsLock.Unlock()
-
-	default:
-		glog.Fatal(fmt.Errorf("Not yet implemented for %d", itemTypeID))
-	}
+	itemID int64,
+) error {
+	return updateStateMap(originID, itemTypeID, oldID, itemID)
 }
 
-// GetNewID checks if the old_id has already been imported for the given
-// item type and returns the new item ID if so.
-func GetNewID(
+func updateStateMap(
 	originID int64,
 	itemTypeID int64,
 	oldID int64,
-) int64 {
-
-	var itemID int64
-
-	switch itemTypeID {
-	case h.ItemTypes[h.ItemTypeMicrocosm]:
-		microcosmsLock.RLock()
-		if newID, ok := microcosms[oldID]; ok {
-			itemID = newID
-		}
-		microcosmsLock.RUnlock()
-
-	case h.ItemTypes[h.ItemTypeProfile]:
-		profilesLock.RLock()
-		if newID, ok := profiles[oldID]; ok {
-			itemID = newID
-		}
-		profilesLock.RUnlock()
+	newID int64,
+) error {
 
-	case h.ItemTypes[h.ItemTypeConversation]:
-		conversationsLock.RLock()
-		if newID, ok := conversations[oldID]; ok {
-			itemID = newID
-		}
-		conversationsLock.RUnlock()
+	it, err := registry.Get(itemTypeID)
+	if err != nil {
+		return err
+	}
 
-	case h.ItemTypes[h.ItemTypeComment]:
-		commentsLock.RLock()
-		if newID, ok := comments[oldID]; ok {
-			itemID = newID
-		}
-		commentsLock.RUnlock()
+	it.SetID(originID, oldID, newID)
 
-	case h.ItemTypes[h.ItemTypeWatcher]:
-		rolesLock.RLock()
-		if newID, ok := roles[oldID]; ok {
-			itemID = newID
-		}
-		rolesLock.RUnlock()
+	return nil
+}
 
-	case h.ItemTypes[h.ItemTypeWatcher]:
-		watchersLock.RLock()
-		if newID, ok := watchers[oldID]; ok {
-			itemID = newID
-		}
-		watchersLock.RUnlock()
+// CountImports returns the number of items of the given item type that are
+// known to have been imported by the origin, either by this run or by a prior
+// run when the prior imports have been loaded.
+func CountImports(originID int64, itemTypeID int64) (int, error) {
+	it, err := registry.Get(itemTypeID)
+	if err != nil {
+		// Nothing of an unregistered item type can have been imported
+		glog.Error(err)
+		return 0, nil
+	}
 
-	case h.ItemTypes[h.ItemTypeHuddle]:
-		huddlesLock.RLock()
-		if newID, ok := huddles[oldID]; ok {
-			itemID = newID
-		}
-		huddlesLock.RUnlock()
+	return it.CountIDs(originID)
+}
 
-	case h.ItemTypes[h.ItemTypeAttachment]:
-		attachmentsLock.RLock()
-		if newID, ok := attachments[oldID]; ok {
-			itemID = newID
-		}
-		attachmentsLock.RUnlock()
+// GetNewID checks if the old_id has already been imported for the given
+// item type and returns the new item ID if so, or 0 if not. An error is only
+// returned when the IDs could not be read.
+func GetNewID(
+	originID int64,
+	itemTypeID int64,
+	oldID int64,
+) (int64, error) {
 
-	default:
-		glog.Fatal(fmt.Errorf("Not yet implemented for %d", itemTypeID))
+	it, err := registry.Get(itemTypeID)
+	if err != nil {
+		// Nothing of an unregistered item type can have been imported
+		glog.Error(err)
+		return 0, nil
 	}
 
-	return itemID
+	itemID, _, err := it.GetID(originID, oldID)
+
+	return itemID, err
 }
 
 // LoadPriorImports will load all item IDs from the imported_items table for a
@@ -301,6 +332,14 @@ func GetNewID(
 // Potentially very expensive, use with care.
 func LoadPriorImports(originID int64) {
 
+	if diskPath != "" {
+		err := recoverDisk(originID)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
 	fmt.Println("Mapping existing records...")
 	glog.Info("Mapping existing records...")
 
@@ -355,7 +394,11 @@ WHERE origin_id = $1`,
 			glog.Fatal(err)
 		}
 
-		updateStateMap(itemTypeID, oldID, newID)
+		err = updateStateMap(originID, itemTypeID, oldID, newID)
+		if err != nil {
+			// Not fatal, an unregistered item type is never looked up
+			glog.Errorf("Failed to load prior import: %+v", err)
+		}
 	}
 	err = rows.Err()
 	if err != nil {
@@ -366,3 +409,39 @@ WHERE origin_id = $1`,
 	bar.Finish()
 
 }
+
+// RecordImports records the import of several items of a single item type
+// with one statement, oldIDs[i] having been imported as itemIDs[i]. Unlike
+// RecordImport the maps of old to new IDs are not updated, RecordImportInMemory
+// must be called for each item once the transaction has been committed.
+func RecordImports(
+	tx *sql.Tx,
+	originID int64,
+	itemTypeID int64,
+	oldIDs []int64,
+	itemIDs []int64,
+) error {
+
+	if len(oldIDs) == 0 {
+		return nil
+	}
+
+	values := []string{}
+	params := []interface{}{originID, itemTypeID}
+	for i := range oldIDs {
+		params = append(params, oldIDs[i], itemIDs[i])
+		values = append(
+			values,
+			fmt.Sprintf("($1, $2, $%d, $%d)", len(params)-1, len(params)),
+		)
+	}
+
+	_, err := tx.Exec(`
+INSERT into imported_items (
+	origin_id, item_type_id, old_id, item_id
+) VALUES `+strings.Join(values, ","),
+		params...,
+	)
+
+	return err
+}
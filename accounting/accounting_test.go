@@ -0,0 +1,194 @@
+package accounting
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+func TestGetNewID(t *testing.T) {
+	const (
+		originID      int64 = 1001
+		otherOriginID int64 = 1002
+	)
+
+	// Every item type is given its own IDs, and all of them are recorded before
+	// any are looked up, so that item types sharing a map would be noticed
+	type pair struct{ oldID, newID int64 }
+	pairs := func(i int) []pair {
+		return []pair{
+			{3212311 + int64(i), 45984 + int64(i)},
+			{1 + int64(i), 2 + int64(i)},
+		}
+	}
+
+	for i, it := range registry.All() {
+		for _, p := range pairs(i) {
+			err := updateStateMap(originID, it.ID, p.oldID, p.newID)
+			if err != nil {
+				t.Fatalf("%s: failed to update state map: %+v", it.Name, err)
+			}
+		}
+	}
+
+	for i, it := range registry.All() {
+		for _, p := range pairs(i) {
+			for j, other := range registry.All() {
+				want := int64(0)
+				if j == i {
+					want = p.newID
+				}
+
+				got, err := GetNewID(originID, other.ID, p.oldID)
+				if err != nil || got != want {
+					t.Errorf(
+						"%s: GetNewID(%d) of %s = %d, %v, want %d",
+						other.Name,
+						p.oldID,
+						it.Name,
+						got,
+						err,
+						want,
+					)
+				}
+			}
+
+			got, err := GetNewID(otherOriginID, it.ID, p.oldID)
+			if err != nil || got != 0 {
+				t.Errorf(
+					"%s: GetNewID(%d) of another origin = %d, %v, want 0",
+					it.Name,
+					p.oldID,
+					got,
+					err,
+				)
+			}
+		}
+
+		if got, err := GetNewID(originID, it.ID, 9999999); err != nil || got != 0 {
+			t.Errorf("%s: GetNewID of an unknown ID = %d, %v, want 0", it.Name, got, err)
+		}
+
+		if n, err := CountImports(originID, it.ID); err != nil || n != 2 {
+			t.Errorf("%s: CountImports = %d, %v, want 2", it.Name, n, err)
+		}
+		if n, err := CountImports(otherOriginID, it.ID); err != nil || n != 0 {
+			t.Errorf("%s: CountImports of another origin = %d, %v, want 0", it.Name, n, err)
+		}
+	}
+}
+
+func TestUpdateStateMapOverwrites(t *testing.T) {
+	const originID int64 = 1003
+
+	for _, it := range registry.All() {
+		for _, newID := range []int64{10, 20} {
+			err := updateStateMap(originID, it.ID, 5, newID)
+			if err != nil {
+				t.Fatalf("%s: failed to update state map: %+v", it.Name, err)
+			}
+		}
+
+		if got, err := GetNewID(originID, it.ID, 5); err != nil || got != 20 {
+			t.Errorf("%s: GetNewID = %d, %v, want 20", it.Name, got, err)
+		}
+		if n, err := CountImports(originID, it.ID); err != nil || n != 1 {
+			t.Errorf("%s: CountImports = %d, %v, want 1", it.Name, n, err)
+		}
+	}
+}
+
+func TestUnregisteredItemType(t *testing.T) {
+	const (
+		originID   int64 = 1004
+		itemTypeID int64 = -1
+	)
+
+	if err := updateStateMap(originID, itemTypeID, 1, 2); err == nil {
+		t.Error("Expected an error updating the state map of an unregistered item type")
+	}
+	if got, err := GetNewID(originID, itemTypeID, 1); err != nil || got != 0 {
+		t.Errorf("GetNewID = %d, %v, want 0", got, err)
+	}
+	if n, err := CountImports(originID, itemTypeID); err != nil || n != 0 {
+		t.Errorf("CountImports = %d, %v, want 0", n, err)
+	}
+}
+
+// The message of an imported huddle is a comment on it that is never recorded
+// as an imported comment, and so must not be reported as unmapped
+func TestUnmappedCommentsOfHuddles(t *testing.T) {
+	query, ok := unmappedItemQueries[h.ItemTypeComment]
+	if !ok {
+		t.Fatal("Expected unmapped comments to be looked for")
+	}
+
+	for _, test := range []struct {
+		itemType string
+		want     bool
+	}{
+		{h.ItemTypeConversation, true},
+		{h.ItemTypeHuddle, false},
+	} {
+		condition := fmt.Sprintf("item_type_id = %d", h.ItemTypes[test.itemType])
+		if got := strings.Contains(query, condition); got != test.want {
+			t.Errorf(
+				"Comments of %s looked for = %t, want %t",
+				test.itemType,
+				got,
+				test.want,
+			)
+		}
+	}
+}
+
+// The avatar of an imported profile is an attachment to it that is not recorded
+// as an imported attachment, and so must be detached and removed with the
+// profile before the profile is deleted
+func TestRollbackProfilesRemovesAvatars(t *testing.T) {
+	queries, ok := rollbackQueries[h.ItemTypeProfile]
+	if !ok {
+		t.Fatal("Expected profiles to be rolled back")
+	}
+
+	find := func(prefix string) int {
+		for i, query := range queries {
+			if strings.HasPrefix(strings.TrimSpace(query), prefix) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	detach := find("UPDATE profiles\n   SET avatar_id = NULL")
+	attachments := find("DELETE FROM attachments")
+	profiles := find("DELETE FROM profiles")
+
+	if detach < 0 || attachments < 0 || profiles < 0 {
+		t.Fatalf(
+			"Expected avatars to be detached (%d), attachments deleted (%d) "+
+				"and profiles deleted (%d)",
+			detach,
+			attachments,
+			profiles,
+		)
+	}
+	if !(detach < attachments && attachments < profiles) {
+		t.Errorf(
+			"Avatars detached at %d and deleted at %d, want both before the "+
+				"profiles are deleted at %d",
+			detach,
+			attachments,
+			profiles,
+		)
+	}
+
+	condition := fmt.Sprintf("item_type_id = %d", h.ItemTypes[h.ItemTypeProfile])
+	if !strings.Contains(queries[attachments], condition) {
+		t.Errorf("Expected only the attachments to profiles to be deleted")
+	}
+}
@@ -0,0 +1,464 @@
+package accounting
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+// The number of IDs that are held in memory before being written to disk
+const diskBatchSize = 1000
+
+var (
+	// diskPath is the directory holding the ID files, when the disk store is
+	// in use
+	diskPath string
+
+	// diskDBs[originID] = the open ID file for the origin
+	diskDBs     = make(map[int64]*bolt.DB)
+	diskDBsLock sync.Mutex
+
+	// diskSynced[originID] = whether the ID file holds every ID of the origin
+	// in imported_items, because it was closed cleanly by the last run or has
+	// been recovered. Only such a file is recorded as clean when it is closed.
+	diskSynced = make(map[int64]bool)
+
+	// The bucket of an ID file that records whether it was closed cleanly
+	diskMetaBucket = []byte("meta")
+	diskCleanKey   = []byte("clean")
+)
+
+// UseDiskStore keeps the maps of old to new IDs in a file per origin within
+// dirPath, rather than in memory. The files persist between runs so a resumed
+// import does not need to load every prior import before it can start.
+//
+// IDs are written to the files in batches, so a run that stops without closing
+// the store loses the IDs of its last batch. The files record whether they were
+// closed cleanly, and when one was not the IDs missing from it are recovered
+// from imported_items by LoadPriorImports before the import resumes.
+func UseDiskStore(dirPath string) {
+	diskPath = dirPath
+
+	for _, it := range registry.All() {
+		it.SetStore(newDiskStore(it.ID))
+	}
+}
+
+// CloseStore writes any IDs still held in memory to disk and closes the ID
+// files, recording that they were closed cleanly if every ID was written. It
+// does nothing when the disk store is not in use.
+func CloseStore() {
+	if diskPath == "" {
+		return
+	}
+
+	clean := true
+	for _, it := range registry.All() {
+		store, ok := it.Store().(*diskStore)
+		if !ok {
+			continue
+		}
+
+		err := store.flush()
+		if err != nil {
+			glog.Errorf("Failed to write IDs to disk: %+v", err)
+			clean = false
+		}
+	}
+
+	diskDBsLock.Lock()
+	defer diskDBsLock.Unlock()
+
+	for originID, db := range diskDBs {
+		if clean && diskSynced[originID] {
+			err := setDiskClean(db, true)
+			if err != nil {
+				glog.Errorf("Failed to mark IDs for origin %d clean: %+v", originID, err)
+			}
+		}
+
+		err := db.Close()
+		if err != nil {
+			glog.Errorf("Failed to close IDs for origin %d: %+v", originID, err)
+		}
+		delete(diskDBs, originID)
+	}
+}
+
+// diskStore is a registry.IDStore for a single item type held in a bolt file per
+// origin, with a bucket per item type
+type diskStore struct {
+	bucket     []byte
+	itemTypeID int64
+
+	// Guards pending, as callers may hold only a read lock whilst calling Get
+	sync.Mutex
+
+	// pending[originID][oldID] = newID, for IDs not yet written to disk
+	pending      registry.MemoryStore
+	pendingCount int
+}
+
+func newDiskStore(itemTypeID int64) *diskStore {
+	return &diskStore{
+		bucket:     []byte(strconv.FormatInt(itemTypeID, 10)),
+		itemTypeID: itemTypeID,
+		pending:    registry.NewMemoryStore(),
+	}
+}
+
+func (s *diskStore) Set(originID int64, oldID int64, newID int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending.Set(originID, oldID, newID)
+	s.pendingCount++
+
+	if s.pendingCount >= diskBatchSize {
+		err := s.write()
+		if err != nil {
+			// Not fatal, the IDs are kept in memory until they are written
+			glog.Errorf("Failed to write IDs to disk: %+v", err)
+		}
+	}
+}
+
+// Get looks for the ID amongst those not yet written to disk, and then on disk.
+// The pending IDs are only moved to disk once they have been written, so an ID
+// that is not pending when looked for there will be found on disk.
+func (s *diskStore) Get(originID int64, oldID int64) (int64, bool, error) {
+	s.Lock()
+	newID, ok, _ := s.pending.Get(originID, oldID)
+	s.Unlock()
+
+	if ok {
+		return newID, true, nil
+	}
+
+	db, err := openDisk(originID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get(diskKey(oldID))
+		if v != nil {
+			newID = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	return newID, newID != 0, nil
+}
+
+// Count returns the number of imported items in imported_items, as the file
+// may not hold all of them
+func (s *diskStore) Count(originID int64) (int, error) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = db.QueryRow(`
+SELECT COUNT(*)
+  FROM imported_items
+ WHERE origin_id = $1
+   AND item_type_id = $2`,
+		originID,
+		s.itemTypeID,
+	).Scan(
+		&count,
+	)
+
+	return count, err
+}
+
+// flush writes the pending IDs to disk
+func (s *diskStore) flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.write()
+}
+
+// write writes the pending IDs to disk, the caller must hold the lock
+func (s *diskStore) write() error {
+	for originID, ids := range s.pending {
+		db, err := openDisk(originID)
+		if err != nil {
+			return err
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(s.bucket)
+			if err != nil {
+				return err
+			}
+
+			for oldID, newID := range ids {
+				err = b.Put(diskKey(oldID), diskKey(newID))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.pending = registry.NewMemoryStore()
+	s.pendingCount = 0
+
+	return nil
+}
+
+// openDisk returns the ID file for the origin, opening it if needed
+func openDisk(originID int64) (*bolt.DB, error) {
+	diskDBsLock.Lock()
+	defer diskDBsLock.Unlock()
+
+	if db, ok := diskDBs[originID]; ok {
+		return db, nil
+	}
+
+	db, err := bolt.Open(
+		path.Join(diskPath, fmt.Sprintf("import_ids_%d.db", originID)),
+		0600,
+		&bolt.Options{Timeout: time.Second},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is only clean again once this run closes it
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(diskMetaBucket)
+		if b != nil && b.Get(diskCleanKey) != nil {
+			diskSynced[originID] = true
+		}
+		return nil
+	})
+	if err == nil {
+		err = setDiskClean(db, false)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	diskDBs[originID] = db
+
+	return db, nil
+}
+
+// setDiskClean records whether the ID file was closed cleanly
+func setDiskClean(db *bolt.DB, clean bool) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(diskMetaBucket)
+		if err != nil {
+			return err
+		}
+
+		if clean {
+			return b.Put(diskCleanKey, []byte{1})
+		}
+		return b.Delete(diskCleanKey)
+	})
+}
+
+// recoverDisk writes the IDs of the origin that are in imported_items to its
+// ID file, unless the file was closed cleanly and so already holds them. Only
+// a run that stopped without closing the store, or an origin that was imported
+// before the disk store was used, needs this.
+func recoverDisk(originID int64) error {
+	db, err := openDisk(originID)
+	if err != nil {
+		return err
+	}
+
+	diskDBsLock.Lock()
+	synced := diskSynced[originID]
+	diskDBsLock.Unlock()
+
+	if synced {
+		fmt.Println("Prior imports will be read from disk as needed")
+		glog.Info("Prior imports will be read from disk as needed")
+		return nil
+	}
+
+	fmt.Println("Recovering prior imports that were not written to disk...")
+	glog.Info("Recovering prior imports that were not written to disk...")
+
+	conn, err := h.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(`
+SELECT item_type_id
+      ,old_id::bigint
+      ,item_id
+  FROM imported_items
+ WHERE origin_id = $1`,
+		originID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// bucketIDs[bucket][oldID] = newID, written every diskBatchSize rows
+	bucketIDs := map[string]map[int64]int64{}
+	var count int
+	write := func() error {
+		err := db.Update(func(tx *bolt.Tx) error {
+			for bucket, ids := range bucketIDs {
+				b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+				if err != nil {
+					return err
+				}
+
+				for oldID, newID := range ids {
+					err = b.Put(diskKey(oldID), diskKey(newID))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+
+		bucketIDs = map[string]map[int64]int64{}
+		count = 0
+
+		return err
+	}
+
+	for rows.Next() {
+		var (
+			itemTypeID int64
+			oldID      int64
+			newID      int64
+		)
+		err = rows.Scan(
+			&itemTypeID,
+			&oldID,
+			&newID,
+		)
+		if err != nil {
+			return err
+		}
+
+		bucket := strconv.FormatInt(itemTypeID, 10)
+		if _, ok := bucketIDs[bucket]; !ok {
+			bucketIDs[bucket] = map[int64]int64{}
+		}
+		bucketIDs[bucket][oldID] = newID
+		count++
+
+		if count >= diskBatchSize {
+			err = write()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	err = write()
+	if err != nil {
+		return err
+	}
+
+	diskDBsLock.Lock()
+	diskSynced[originID] = true
+	diskDBsLock.Unlock()
+
+	return nil
+}
+
+// newDiskOrigin records that the origin has only just been created, so there
+// is nothing in imported_items that its ID file could be missing
+func newDiskOrigin(originID int64) {
+	if diskPath == "" {
+		return
+	}
+
+	diskDBsLock.Lock()
+	diskSynced[originID] = true
+	diskDBsLock.Unlock()
+}
+
+func diskKey(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// ForgetDiskImports removes the IDs of the items with the old IDs from the ID
+// file of the origin, once ForgetImports has been committed, so that they are
+// imported again. It does nothing when the disk store is not in use.
+func ForgetDiskImports(originID int64, itemTypeID int64, oldIDs []int64) error {
+	if diskPath == "" || len(oldIDs) == 0 {
+		return nil
+	}
+
+	it, err := registry.Get(itemTypeID)
+	if err != nil {
+		return err
+	}
+	store, ok := it.Store().(*diskStore)
+	if !ok {
+		return nil
+	}
+
+	// Any that are pending would be written to disk again
+	err = store.flush()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDisk(originID)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(store.bucket)
+		if b == nil {
+			return nil
+		}
+
+		for _, oldID := range oldIDs {
+			err := b.Delete(diskKey(oldID))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
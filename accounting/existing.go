@@ -0,0 +1,54 @@
+package accounting
+
+import (
+	"database/sql"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+)
+
+// RecordExisting records that an item adopted by an import, such as a profile
+// matched by email address or a microcosm merged into, existed on the site
+// before any import. Rolling back an import keeps such items, as they were not
+// created by it. The item may already have been recorded by another origin.
+func RecordExisting(tx *sql.Tx, itemTypeID int64, itemID int64) error {
+	_, err := tx.Exec(`
+INSERT INTO import_existing_items (
+	item_type_id, item_id
+)
+SELECT $1, $2
+ WHERE NOT EXISTS (
+           SELECT 1
+             FROM import_existing_items
+            WHERE item_type_id = $1
+              AND item_id = $2
+       )`,
+		itemTypeID,
+		itemID,
+	)
+
+	return err
+}
+
+// IsImported returns whether any origin has recorded the item as imported
+func IsImported(itemTypeID int64, itemID int64) (bool, error) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return false, err
+	}
+
+	var imported bool
+	err = db.QueryRow(`
+SELECT EXISTS (
+           SELECT 1
+             FROM imported_items
+            WHERE item_type_id = $1
+              AND item_id = $2
+       )`,
+		itemTypeID,
+		itemID,
+	).Scan(
+		&imported,
+	)
+
+	return imported, err
+}
@@ -0,0 +1,110 @@
+package accounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+// Failure records an item that could not be imported
+type Failure struct {
+	OldID int64  `json:"oldId"`
+	Error string `json:"error"`
+}
+
+// ledgerPath returns the path of the failure ledger for an origin and item type
+func ledgerPath(rootPath string, originID int64, itemTypeID int64) string {
+	return path.Join(
+		rootPath,
+		fmt.Sprintf(
+			"import_failures_%d_%s.json",
+			originID,
+			registry.Name(itemTypeID),
+		),
+	)
+}
+
+// RecordFailures replaces the failure ledger for an item type with the items
+// that failed in the most recent run of that item type. The ledger is a file
+// within the export root and is removed when there are no failures.
+func RecordFailures(
+	rootPath string,
+	originID int64,
+	itemTypeID int64,
+	failures []Failure,
+) error {
+
+	ledger := ledgerPath(rootPath, originID, itemTypeID)
+
+	if len(failures) == 0 {
+		if files.Exists(ledger) {
+			return os.Remove(ledger)
+		}
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ledger, bytes, 0644)
+}
+
+// LoadFailures returns the items in the failure ledger for an item type
+func LoadFailures(
+	rootPath string,
+	originID int64,
+	itemTypeID int64,
+) (
+	[]Failure,
+	error,
+) {
+
+	failures := []Failure{}
+
+	ledger := ledgerPath(rootPath, originID, itemTypeID)
+	if !files.Exists(ledger) {
+		return failures, nil
+	}
+
+	err := files.JSONFileToInterface(ledger, &failures)
+	if err != nil {
+		return failures, err
+	}
+
+	return failures, nil
+}
+
+// AddFailures adds items to the failure ledger for an item type, keeping those
+// already in it, so that they are imported when failures are retried
+func AddFailures(
+	rootPath string,
+	originID int64,
+	itemTypeID int64,
+	failures []Failure,
+) error {
+
+	existing, err := LoadFailures(rootPath, originID, itemTypeID)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[int64]bool)
+	for _, failure := range existing {
+		listed[failure.OldID] = true
+	}
+	for _, failure := range failures {
+		if !listed[failure.OldID] {
+			existing = append(existing, failure)
+			listed[failure.OldID] = true
+		}
+	}
+
+	return RecordFailures(rootPath, originID, itemTypeID, existing)
+}
@@ -0,0 +1,117 @@
+package accounting
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+)
+
+// Most items are created by the microcosm models, which commit their own
+// transactions, so an item can be created and the import interrupted before
+// its import is recorded. An intent is recorded before an item is created and
+// removed by RecordImport, so that the items of an intent that remains may
+// have been created by an interrupted run. The import of those items looks for
+// the orphaned item and adopts it rather than creating it again.
+
+// interrupted[itemTypeID][oldID] is true when a prior run recorded the intent
+// to create the item but not its import
+var (
+	interrupted     = make(map[int64]map[int64]bool)
+	interruptedLock sync.RWMutex
+)
+
+// RecordIntent records that the item with the old ID is about to be created
+func RecordIntent(
+	tx *sql.Tx,
+	originID int64,
+	itemTypeID int64,
+	oldID int64,
+) error {
+
+	_, err := tx.Exec(`
+INSERT INTO import_intents (
+	origin_id, item_type_id, old_id
+)
+SELECT $1, $2, $3
+ WHERE NOT EXISTS (
+           SELECT 1
+             FROM import_intents
+            WHERE origin_id = $1
+              AND item_type_id = $2
+              AND old_id = $3
+       )`,
+		originID,
+		itemTypeID,
+		oldID,
+	)
+
+	return err
+}
+
+// LoadInterrupted loads the intents left by prior runs of the import, the
+// items of which may have been created without their import being recorded
+func LoadInterrupted(originID int64) {
+	db, err := h.GetConnection()
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	rows, err := db.Query(`
+SELECT item_type_id
+      ,old_id
+  FROM import_intents
+ WHERE origin_id = $1`,
+		originID,
+	)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer rows.Close()
+
+	interruptedLock.Lock()
+	defer interruptedLock.Unlock()
+
+	var count int
+	for rows.Next() {
+		var (
+			itemTypeID int64
+			oldID      int64
+		)
+		err = rows.Scan(
+			&itemTypeID,
+			&oldID,
+		)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		if _, ok := interrupted[itemTypeID]; !ok {
+			interrupted[itemTypeID] = make(map[int64]bool)
+		}
+		interrupted[itemTypeID][oldID] = true
+		count++
+	}
+	err = rows.Err()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	rows.Close()
+
+	if count > 0 {
+		fmt.Printf("%d items may have been created by an interrupted run\n", count)
+		glog.Infof("%d items may have been created by an interrupted run", count)
+	}
+}
+
+// Interrupted returns true when a prior run of the import may have created the
+// item without recording its import
+func Interrupted(itemTypeID int64, oldID int64) bool {
+	interruptedLock.RLock()
+	defer interruptedLock.RUnlock()
+
+	return interrupted[itemTypeID][oldID]
+}
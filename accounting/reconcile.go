@@ -0,0 +1,256 @@
+package accounting
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+)
+
+// liveItemQueries find the item that an imported_items row, aliased i, points
+// at. Follows are recorded once per profile rather than per watcher, so the
+// watchers of the profile are looked for, and attachments are recorded by the
+// ID of their file.
+var liveItemQueries = map[string]string{
+	h.ItemTypeProfile: `
+SELECT 1
+  FROM profiles
+ WHERE profile_id = i.item_id`,
+	h.ItemTypeMicrocosm: `
+SELECT 1
+  FROM microcosms
+ WHERE microcosm_id = i.item_id`,
+	h.ItemTypeConversation: `
+SELECT 1
+  FROM conversations
+ WHERE conversation_id = i.item_id`,
+	h.ItemTypeComment: `
+SELECT 1
+  FROM comments
+ WHERE comment_id = i.item_id`,
+	h.ItemTypeHuddle: `
+SELECT 1
+  FROM huddles
+ WHERE huddle_id = i.item_id`,
+	h.ItemTypeAttachment: `
+SELECT 1
+  FROM attachments
+ WHERE attachment_meta_id = i.item_id`,
+	h.ItemTypeRole: `
+SELECT 1
+  FROM roles
+ WHERE role_id = i.item_id`,
+	// Follows were once recorded with the new ID 1 rather than that of the
+	// profile, and those cannot be checked
+	h.ItemTypeWatcher: `
+SELECT 1
+ WHERE i.item_id = 1
+ UNION ALL
+SELECT 1
+  FROM watchers
+ WHERE profile_id = i.item_id`,
+}
+
+// exportedBefore is a condition that the created column of an item is no later
+// than when the export of the origin in $1 was made, so that items created on
+// the site since are not mistaken for items of the import
+const exportedBefore = `
+   AND created <= COALESCE(
+           (SELECT exported FROM import_origins WHERE origin_id = $1),
+           'infinity'
+       )`
+
+// unmappedItemQueries find the items that belong to items imported by the
+// origin in $1 but which no origin has recorded as imported. Those of item
+// types that may have existed on the site before the import, such as profiles
+// and microcosms, cannot be told apart from items of the import. The message of
+// a huddle is a comment on it that is never recorded as an imported comment, so
+// the comments of huddles are not looked for.
+var unmappedItemQueries = map[string]string{
+	h.ItemTypeConversation: fmt.Sprintf(`
+SELECT conversation_id
+  FROM conversations
+ WHERE microcosm_id IN (%s)
+   AND %s`+exportedBefore,
+		mappedItemIDs(h.ItemTypeMicrocosm),
+		notMapped(h.ItemTypeConversation, "conversation_id"),
+	),
+	h.ItemTypeComment: fmt.Sprintf(`
+SELECT comment_id
+  FROM comments
+ WHERE item_type_id = %d
+   AND item_id IN (%s)
+   AND %s`+exportedBefore,
+		h.ItemTypes[h.ItemTypeConversation],
+		mappedItemIDs(h.ItemTypeConversation),
+		notMapped(h.ItemTypeComment, "comment_id"),
+	),
+	h.ItemTypeHuddle: fmt.Sprintf(`
+SELECT huddle_id
+  FROM huddles
+ WHERE created_by IN (%s)
+   AND %s`+exportedBefore,
+		mappedItemIDs(h.ItemTypeProfile),
+		notMapped(h.ItemTypeHuddle, "huddle_id"),
+	),
+	h.ItemTypeAttachment: fmt.Sprintf(`
+SELECT attachment_id
+  FROM attachments
+ WHERE item_type_id = %d
+   AND item_id IN (%s)
+   AND %s`+exportedBefore,
+		h.ItemTypes[h.ItemTypeComment],
+		mappedItemIDs(h.ItemTypeComment),
+		notMapped(h.ItemTypeAttachment, "attachment_meta_id"),
+	),
+}
+
+// mappedItemIDs returns a query for the new IDs of the items of the item type
+// recorded as imported by the origin in $1
+func mappedItemIDs(itemType string) string {
+	return fmt.Sprintf(`
+SELECT item_id
+  FROM imported_items
+ WHERE origin_id = $1
+   AND item_type_id = %d`,
+		h.ItemTypes[itemType],
+	)
+}
+
+// notMapped returns a condition that the new ID in the column has not been
+// recorded as imported as an item of the item type by any origin
+func notMapped(itemType string, column string) string {
+	return fmt.Sprintf(`NOT EXISTS (
+           SELECT 1
+             FROM imported_items m
+            WHERE m.item_type_id = %d
+              AND m.item_id = %s
+       )`,
+		h.ItemTypes[itemType],
+		column,
+	)
+}
+
+// CanReconcile returns whether the imports of the item type can be checked
+// against the items they point at, and whether items of the item type that
+// were created without being recorded can be found
+func CanReconcile(itemType string) (bool, bool) {
+	_, dangling := liveItemQueries[itemType]
+	_, unmapped := unmappedItemQueries[itemType]
+
+	return dangling, unmapped
+}
+
+// GetDanglingImports returns the old IDs of the items of the item type that
+// the origin recorded as imported but which no longer exist
+func GetDanglingImports(originID int64, itemType string) ([]int64, error) {
+	query, ok := liveItemQueries[itemType]
+	if !ok {
+		return nil, fmt.Errorf("Cannot check imports of item type: %s", itemType)
+	}
+
+	return queryIDs(`
+SELECT i.old_id::bigint
+  FROM imported_items i
+ WHERE i.origin_id = $1
+   AND i.item_type_id = $2
+   AND NOT EXISTS (`+query+`
+       )
+ ORDER BY 1`,
+		originID,
+		h.ItemTypes[itemType],
+	)
+}
+
+// GetUnmappedItems returns the IDs of items of the item type that belong to
+// the import of the origin but were not recorded as imported
+func GetUnmappedItems(originID int64, itemType string) ([]int64, error) {
+	query, ok := unmappedItemQueries[itemType]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find unmapped items of item type: %s", itemType)
+	}
+
+	return queryIDs(query+`
+ ORDER BY 1`,
+		originID,
+	)
+}
+
+// GetIntents returns the old IDs of the items of the item type whose creation
+// was started but whose import was never recorded, see RecordIntent
+func GetIntents(originID int64, itemTypeID int64) ([]int64, error) {
+	return queryIDs(`
+SELECT old_id
+  FROM import_intents
+ WHERE origin_id = $1
+   AND item_type_id = $2
+ ORDER BY old_id`,
+		originID,
+		itemTypeID,
+	)
+}
+
+// ForgetImports removes the record of the import of the items with the old
+// IDs, so that they are imported again
+func ForgetImports(
+	tx *sql.Tx,
+	originID int64,
+	itemTypeID int64,
+	oldIDs []int64,
+) error {
+
+	if len(oldIDs) == 0 {
+		return nil
+	}
+
+	// The IDs are given as a single parameter as there may be too many for
+	// a parameter each
+	ids := []string{}
+	for _, oldID := range oldIDs {
+		ids = append(ids, fmt.Sprintf("%d", oldID))
+	}
+
+	_, err := tx.Exec(`
+DELETE FROM imported_items
+ WHERE origin_id = $1
+   AND item_type_id = $2
+   AND old_id = ANY(string_to_array($3, ','))`,
+		originID,
+		itemTypeID,
+		strings.Join(ids, ","),
+	)
+
+	return err
+}
+
+// queryIDs returns the single column of IDs returned by the query
+func queryIDs(query string, params ...interface{}) ([]int64, error) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return ids, nil
+}
@@ -0,0 +1,163 @@
+package accounting
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+)
+
+// RecordReply records that an imported comment is in reply to the comment with
+// the old ID, which may not have been imported yet. The comment is threaded by
+// ThreadReplies once the comment it replies to has been imported. The reply of
+// a comment adopted from an interrupted run may already have been recorded.
+func RecordReply(
+	tx *sql.Tx,
+	originID int64,
+	commentID int64,
+	oldInReplyTo int64,
+) error {
+
+	_, err := tx.Exec(`
+INSERT INTO import_replies (
+	origin_id, comment_id, old_in_reply_to
+)
+SELECT $1, $2, $3
+ WHERE NOT EXISTS (
+           SELECT 1
+             FROM import_replies
+            WHERE comment_id = $2
+       )`,
+		originID,
+		commentID,
+		oldInReplyTo,
+	)
+
+	return err
+}
+
+// RecordReplies records the replies of several comments with one statement,
+// commentIDs[i] being in reply to the comment with the old ID oldInReplyTos[i]
+func RecordReplies(
+	tx *sql.Tx,
+	originID int64,
+	commentIDs []int64,
+	oldInReplyTos []int64,
+) error {
+
+	if len(commentIDs) == 0 {
+		return nil
+	}
+
+	values := []string{}
+	params := []interface{}{originID}
+	for i := range commentIDs {
+		params = append(params, commentIDs[i], oldInReplyTos[i])
+		values = append(
+			values,
+			fmt.Sprintf("($1, $%d, $%d)", len(params)-1, len(params)),
+		)
+	}
+
+	_, err := tx.Exec(`
+INSERT INTO import_replies (
+	origin_id, comment_id, old_in_reply_to
+) VALUES `+strings.Join(values, ","),
+		params...,
+	)
+
+	return err
+}
+
+// ThreadReplies sets in_reply_to for every comment recorded by RecordReply
+// whose reply has since been imported, and forgets those comments. Replies to
+// a comment in another conversation are invalid and are forgotten without
+// being threaded. It returns the number of comments threaded, the number of
+// invalid replies and the number of replies still waiting for the comment they
+// reply to.
+//
+// As only the replies that have not been threaded are remembered this can be
+// run after every run of the import.
+func ThreadReplies(originID int64) (
+	threaded int64,
+	invalid int64,
+	unresolved int64,
+	err error,
+) {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+WITH threaded AS (
+    UPDATE comments c
+       SET in_reply_to = p.comment_id
+      FROM import_replies r
+      JOIN imported_items i ON i.origin_id = r.origin_id
+                           AND i.item_type_id = $2
+                           AND i.old_id = r.old_in_reply_to::text
+      JOIN comments p ON p.comment_id = i.item_id
+     WHERE r.origin_id = $1
+       AND c.comment_id = r.comment_id
+       AND p.item_type_id = c.item_type_id
+       AND p.item_id = c.item_id
+ RETURNING c.comment_id
+), forgotten AS (
+    DELETE FROM import_replies
+     WHERE origin_id = $1
+       AND comment_id IN (SELECT comment_id FROM threaded)
+ RETURNING comment_id
+)
+SELECT COUNT(*)
+  FROM forgotten`,
+		originID,
+		h.ItemTypes[h.ItemTypeComment],
+	).Scan(
+		&threaded,
+	)
+	if err != nil {
+		return
+	}
+
+	// Those that remain and reply to an imported comment reply to one in
+	// another conversation
+	err = tx.QueryRow(`
+WITH forgotten AS (
+    DELETE FROM import_replies r
+     USING imported_items i
+     WHERE r.origin_id = $1
+       AND i.origin_id = r.origin_id
+       AND i.item_type_id = $2
+       AND i.old_id = r.old_in_reply_to::text
+ RETURNING r.comment_id
+)
+SELECT COUNT(*)
+  FROM forgotten`,
+		originID,
+		h.ItemTypes[h.ItemTypeComment],
+	).Scan(
+		&invalid,
+	)
+	if err != nil {
+		return
+	}
+
+	err = tx.QueryRow(`
+SELECT COUNT(*)
+  FROM import_replies
+ WHERE origin_id = $1`,
+		originID,
+	).Scan(
+		&unresolved,
+	)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+
+	return
+}
@@ -0,0 +1,61 @@
+package accounting
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+// Outcomes of an attempt to import a single item
+const (
+	Created = iota
+	Skipped
+	Orphaned
+	Failed
+)
+
+// Tracks what happened to each item, the structure is
+// outcomes[itemTypeID][outcome] = count
+var (
+	outcomes     = make(map[int64]*[4]int64)
+	outcomesLock sync.Mutex
+)
+
+// RecordOutcome tallies the outcome of an attempt to import an item of the
+// given type
+func RecordOutcome(itemTypeID int64, outcome int) {
+	outcomesLock.Lock()
+	counts, ok := outcomes[itemTypeID]
+	if !ok {
+		counts = &[4]int64{}
+		outcomes[itemTypeID] = counts
+	}
+	counts[outcome]++
+	outcomesLock.Unlock()
+}
+
+// PrintReport prints the tally of outcomes per item type to stdout
+func PrintReport() {
+	outcomesLock.Lock()
+	defer outcomesLock.Unlock()
+
+	fmt.Printf(
+		"%-14s %10s %10s %10s %10s\n",
+		"item type", "created", "skipped", "orphaned", "failed",
+	)
+	for _, it := range registry.All() {
+		counts, ok := outcomes[it.ID]
+		if !ok {
+			counts = &[4]int64{}
+		}
+		fmt.Printf(
+			"%-14s %10d %10d %10d %10d\n",
+			it.Name,
+			counts[Created],
+			counts[Skipped],
+			counts[Orphaned],
+			counts[Failed],
+		)
+	}
+}
@@ -0,0 +1,255 @@
+package accounting
+
+import (
+	"database/sql"
+	"fmt"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+)
+
+// rollbackQueries are the statements that delete the items of each item type
+// that were created by an import origin, along with the rows that depend upon
+// them. Each is passed the origin ID and runs before the imported_items rows of
+// the item type are removed.
+var rollbackQueries = map[string][]string{
+	// Attachments are recorded by the ID of their file, which may also be
+	// attached to items that were not imported, so only the attachments of the
+	// file to imported comments and profiles are removed
+	h.ItemTypeAttachment: {fmt.Sprintf(`
+DELETE FROM attachments
+ WHERE attachment_meta_id IN (`+importedItemIDs(h.ItemTypeAttachment)+`)
+   AND (
+           (item_type_id = %d AND item_id IN (`+importedItemIDs(h.ItemTypeComment)+`))
+        OR (item_type_id = %d AND item_id IN (`+importedItemIDs(h.ItemTypeProfile)+`))
+       )`,
+		h.ItemTypes[h.ItemTypeComment],
+		h.ItemTypes[h.ItemTypeProfile],
+	)},
+	h.ItemTypeComment: {`
+DELETE FROM import_replies
+ WHERE origin_id = $1`, fmt.Sprintf(`
+DELETE FROM ips
+ WHERE item_type_id = %d
+   AND item_id IN (`+importedItemIDs(h.ItemTypeComment)+`)`,
+		h.ItemTypes[h.ItemTypeComment],
+	), `
+UPDATE comments
+   SET in_reply_to = NULL
+ WHERE in_reply_to IN (` + importedItemIDs(h.ItemTypeComment) + `)`, `
+DELETE FROM revisions
+ WHERE comment_id IN (` + importedItemIDs(h.ItemTypeComment) + `)`, `
+DELETE FROM comments
+ WHERE comment_id IN (` + importedItemIDs(h.ItemTypeComment) + `)`,
+	},
+	// The message of a huddle is a comment on it that is not recorded as an
+	// imported comment, so is removed with the huddle
+	h.ItemTypeHuddle: {fmt.Sprintf(`
+DELETE FROM ips
+ WHERE item_type_id = %d
+   AND item_id IN (`+huddleMessageIDs()+`)`,
+		h.ItemTypes[h.ItemTypeComment],
+	), `
+DELETE FROM revisions
+ WHERE comment_id IN (` + huddleMessageIDs() + `)`, `
+DELETE FROM comments
+ WHERE comment_id IN (` + huddleMessageIDs() + `)`, fmt.Sprintf(`
+DELETE FROM ips
+ WHERE item_type_id = %d
+   AND item_id IN (`+importedItemIDs(h.ItemTypeHuddle)+`)`,
+		h.ItemTypes[h.ItemTypeHuddle],
+	), `
+DELETE FROM huddle_profiles
+ WHERE huddle_id IN (` + importedItemIDs(h.ItemTypeHuddle) + `)`, `
+DELETE FROM huddles
+ WHERE huddle_id IN (` + importedItemIDs(h.ItemTypeHuddle) + `)`,
+	},
+	h.ItemTypeConversation: {`
+DELETE FROM conversations
+ WHERE conversation_id IN (` + importedItemIDs(h.ItemTypeConversation) + `)`,
+	},
+	// Microcosms that already existed on the site and were merged into are kept
+	h.ItemTypeMicrocosm: {`
+DELETE FROM microcosms
+ WHERE microcosm_id IN (` + createdItemIDs(h.ItemTypeMicrocosm) + `)`,
+	},
+	h.ItemTypeRole: {`
+DELETE FROM role_profiles
+ WHERE role_id IN (` + importedItemIDs(h.ItemTypeRole) + `)`, `
+DELETE FROM criteria
+ WHERE role_id IN (` + importedItemIDs(h.ItemTypeRole) + `)`, `
+DELETE FROM roles
+ WHERE role_id IN (` + importedItemIDs(h.ItemTypeRole) + `)`,
+	},
+	// A single follow becomes many watchers, so imported_items only records
+	// that the follows of a profile were imported and not the watcher IDs.
+	// Instead the watchers of imported profiles on imported items are removed.
+	h.ItemTypeWatcher: {fmt.Sprintf(`
+DELETE FROM watchers
+ WHERE profile_id IN (`+importedItemIDs(h.ItemTypeProfile)+`)
+   AND (
+           (item_type_id = %d AND item_id IN (`+importedItemIDs(h.ItemTypeProfile)+`))
+        OR (item_type_id = %d AND item_id IN (`+importedItemIDs(h.ItemTypeMicrocosm)+`))
+        OR (item_type_id = %d AND item_id IN (`+importedItemIDs(h.ItemTypeConversation)+`))
+       )`,
+		h.ItemTypes[h.ItemTypeProfile],
+		h.ItemTypes[h.ItemTypeMicrocosm],
+		h.ItemTypes[h.ItemTypeConversation],
+	)},
+	// Profiles that already existed on the site were adopted by the import
+	// rather than created, and the owner of the site cannot be removed. Both
+	// are kept, as is any profile that still has comments once the comments of
+	// the import have been removed. The avatars of the profiles that are
+	// removed are attachments to the profile that are not recorded as imported
+	// attachments, and they and the IP addresses logged for the profiles are
+	// removed with them.
+	h.ItemTypeProfile: {`
+UPDATE profiles
+   SET avatar_id = NULL
+      ,avatar_url = NULL
+ WHERE profile_id IN (` + removedProfileIDs() + `)`, fmt.Sprintf(`
+DELETE FROM attachments
+ WHERE item_type_id = %d
+   AND item_id IN (`+removedProfileIDs()+`)`,
+		h.ItemTypes[h.ItemTypeProfile],
+	), fmt.Sprintf(`
+DELETE FROM ips
+ WHERE item_type_id = %d
+   AND item_id IN (`+removedProfileIDs()+`)`,
+		h.ItemTypes[h.ItemTypeProfile],
+	), `
+DELETE FROM profiles
+ WHERE profile_id IN (` + removedProfileIDs() + `)`,
+	},
+}
+
+// importedItemIDs returns a query for the new IDs of every item of the item
+// type recorded as imported by the origin ID in $1. Items that were also
+// imported by another origin, such as a profile or microcosm that two origins
+// merged into, are excluded as the other origin still needs them.
+func importedItemIDs(itemType string) string {
+	return fmt.Sprintf(`
+SELECT item_id
+  FROM imported_items
+ WHERE origin_id = $1
+   AND item_type_id = %d
+   AND item_id NOT IN (
+           SELECT item_id
+             FROM imported_items
+            WHERE origin_id <> $1
+              AND item_type_id = %d
+       )`,
+		h.ItemTypes[itemType],
+		h.ItemTypes[itemType],
+	)
+}
+
+// huddleMessageIDs returns a query for the comment IDs of the messages of the
+// huddles imported by the origin ID in $1
+func huddleMessageIDs() string {
+	return fmt.Sprintf(`
+SELECT comment_id
+  FROM comments
+ WHERE item_type_id = %d
+   AND item_id IN (`+importedItemIDs(h.ItemTypeHuddle)+`)`,
+		h.ItemTypes[h.ItemTypeHuddle],
+	)
+}
+
+// removedProfileIDs returns a query for the IDs of the profiles that rolling
+// back the origin ID in $1 removes, see rollbackQueries
+func removedProfileIDs() string {
+	return `
+SELECT p.profile_id
+  FROM profiles p
+ WHERE p.profile_id IN (` + createdItemIDs(h.ItemTypeProfile) + `)
+   AND p.profile_id NOT IN (SELECT owned_by FROM sites)
+   AND NOT EXISTS (
+           SELECT 1
+             FROM comments c
+            WHERE c.profile_id = p.profile_id
+       )`
+}
+
+// createdItemIDs returns a query for the new IDs of the items of the item type
+// that the origin ID in $1 created, being those from importedItemIDs that did
+// not exist before the import, see RecordExisting
+func createdItemIDs(itemType string) string {
+	return importedItemIDs(itemType) + fmt.Sprintf(`
+   AND item_id NOT IN (
+           SELECT item_id
+             FROM import_existing_items
+            WHERE item_type_id = %d
+       )`,
+		h.ItemTypes[itemType],
+	)
+}
+
+// RollbackImports deletes every item of the given item type that was created
+// by the import origin, and then forgets that they were imported. It returns
+// the number of items that were recorded as imported.
+func RollbackImports(
+	tx *sql.Tx,
+	originID int64,
+	itemTypeID int64,
+	itemType string,
+) (int64, error) {
+
+	queries, ok := rollbackQueries[itemType]
+	if !ok {
+		return 0, fmt.Errorf("Cannot rollback item type: %s", itemType)
+	}
+
+	for _, query := range queries {
+		_, err := tx.Exec(query, originID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err := tx.Exec(`
+DELETE FROM import_intents
+ WHERE origin_id = $1
+   AND item_type_id = $2`,
+		originID,
+		itemTypeID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+DELETE FROM imported_items
+ WHERE origin_id = $1
+   AND item_type_id = $2`,
+		originID,
+		itemTypeID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteImportOrigin removes the record of an import origin, which must no
+// longer have any imported items
+func DeleteImportOrigin(tx *sql.Tx, originID int64) error {
+	res, err := tx.Exec(`
+DELETE FROM import_origins
+ WHERE origin_id = $1`,
+		originID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("Import origin %d does not exist", originID)
+	}
+
+	return nil
+}
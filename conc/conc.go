@@ -1,8 +1,10 @@
 package conc
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/cheggaaa/pb"
 )
@@ -13,99 +15,232 @@ import (
 // like kind.
 type Args struct {
 	RootPath           string
+	Exported           time.Time
 	SiteID             int64
 	OriginID           int64
 	SiteOwnerProfileID int64
 	ItemTypeID         int64
 	DeletedProfileID   int64
+
+	// DryRun is true when the export is being validated, in which case tasks
+	// must not write to the database
+	DryRun bool
+
+	// ContinueOnError is true when a failed task should not cancel the tasks
+	// that remain
+	ContinueOnError bool
+
+	// RetryFailures is true when only the items in the failure ledger are
+	// being imported
+	RetryFailures bool
+
+	// TargetLatency is how long a task should take when the database is not
+	// struggling. When tasks take longer RunTasks uses fewer gophers. Zero
+	// disables this.
+	TargetLatency time.Duration
+
+	// MaxItemsPerSecond caps the rate at which RunTasks starts tasks. Zero
+	// disables this.
+	MaxItemsPerSecond int64
+
+	// Latency is set when tasks hand their writes to another writer, and so
+	// return before the database has been written to. The throttle then uses
+	// the latencies that the writer records, rather than how long the tasks
+	// took.
+	Latency *LatencyMeter
+}
+
+// TaskError is returned by RunTasks for each task that failed
+type TaskError struct {
+	ID  int64
+	Err error
+}
+
+func (e TaskError) Error() string {
+	return fmt.Sprintf("Failed on ID %d : %+v", e.ID, e.Err)
 }
 
+// Producer sends IDs to ids until it runs out of them, at which point it
+// returns nil. It must return the error from ctx if ctx is cancelled whilst it
+// is sending.
+type Producer func(ctx context.Context, ids chan<- int64) error
+
 // RunTasks will take a range of []int64, some function args, a function and
 // the number of gophers to use, and will then process all tasks evenly across
 // the number of gophers.
+//
+// Unless args.ContinueOnError is true the first task to fail will cancel all of
+// the tasks that remain. A TaskError is returned for every task that failed.
+//
+// The gophers are throttled according to args.TargetLatency and
+// args.MaxItemsPerSecond, so fewer than the number given may be running at any
+// time.
+//
+// Cancelling ctx stops any more tasks from starting, but tasks that are in
+// progress are allowed to finish. The error from ctx is then returned along
+// with any TaskErrors.
 func RunTasks(
+	ctx context.Context,
 	ids []int64,
 	args Args,
 	task func(Args, int64) error,
 	gophers int,
 ) []error {
 
-	// Progress bar
-	bar := pb.StartNew(len(ids))
-
-	// Cancel control
-	done := make(chan struct{})
-	quit := false
+	return RunTaskStream(
+		ctx,
+		func(ctx context.Context, tasks chan<- int64) error {
+			for _, id := range ids {
+				select {
+				case tasks <- id:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		},
+		len(ids),
+		args,
+		task,
+		gophers,
+	)
+}
 
-	// IDs to process, sent via channel
-	tasks := make(chan int64, len(ids)+1)
+// RunTaskStream is RunTasks for IDs that are sent by produce as they are found,
+// rather than all being held in memory first. total is the number of IDs that
+// will be produced, which is only used for the progress bar and may be 0 if it
+// is not known. An error returned by produce is returned along with any
+// TaskErrors.
+func RunTaskStream(
+	ctx context.Context,
+	produce Producer,
+	total int,
+	args Args,
+	task func(Args, int64) error,
+	gophers int,
+) []error {
 
-	errs := []error{}
-	var wg sync.WaitGroup
+	// Progress bar
+	bar := pb.StartNew(total)
+
+	// Cancel control, cancelling this does not cancel the caller's ctx
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// IDs to process, sent via channel. drained is closed once every ID has
+	// been taken from tasks.
+	tasks := make(chan int64)
+	drained := make(chan struct{})
+
+	var (
+		errs     = []error{}
+		errsLock sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	// No need to have more gophers than we have tasks, but we need at least one
+	// to discover whether there are any tasks at all
+	if total > 0 && gophers > total {
+		gophers = total
+	}
+	if gophers < 1 {
+		gophers = 1
+	}
 
-	// No need to have more gophers than we have tasks
-	if gophers > len(ids) {
-		gophers = len(ids)
+	t := newThrottle(gophers, args.TargetLatency, args.MaxItemsPerSecond)
+	if args.Latency != nil {
+		args.Latency.attach(t)
+		defer args.Latency.attach(nil)
 	}
 
 	// Only fire up a set number of worker processes
 	for i := 0; i < gophers; i++ {
 		wg.Add(1)
 
-		go func() {
-			for id := range tasks {
-				err := doTask(args, id, task, done)
+		go func(gopher int) {
+			defer wg.Done()
+
+			for {
+				if !t.wait(runCtx, drained, gopher) {
+					return
+				}
+
+				id, ok := <-tasks
+				if !ok {
+					return
+				}
+
+				start := time.Now()
+				err := doTask(runCtx, args, id, task)
+				if args.Latency == nil {
+					t.observe(time.Since(start))
+				}
+
+				if err != nil && err == runCtx.Err() {
+					// Cancelled, so this task never started
+					return
+				}
 				if err != nil {
-					// Quit as we encountered an error
-					if !quit {
-						// Closing the done channel will cancel tasks handled by
-						// other gophers
-						close(done)
-						quit = true
+					errsLock.Lock()
+					errs = append(errs, TaskError{ID: id, Err: err})
+					errsLock.Unlock()
+
+					if !args.ContinueOnError {
+						// Quit as we encountered an error, cancelling the
+						// tasks handled by other gophers
+						cancel()
+						return
 					}
-					errs = append(
-						errs,
-						fmt.Errorf("Failed on ID %d : %+v", id, err),
-					)
-					break
 				}
 				bar.Increment()
 			}
-			wg.Done()
-		}()
+		}(i)
 	}
 
-	for _, id := range ids {
-		tasks <- id
-	}
-	close(tasks)
+	// Feed the gophers until we run out of tasks or are cancelled
+	produced := make(chan error, 1)
+	go func() {
+		err := produce(runCtx, tasks)
+		close(tasks)
+		close(drained)
+
+		produced <- err
+	}()
 
 	wg.Wait()
-	if !quit {
-		close(done)
+
+	// The gophers only stop before every task has been sent once runCtx is
+	// cancelled, so the producer will stop too
+	cancel()
+	err := <-produced
+	if err != nil && err != runCtx.Err() {
+		errs = append(errs, err)
 	}
 
 	bar.Finish()
 
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+
 	return errs
 }
 
 // doTask runs a single task and returns the error value (nil or err).
-// If the done channel is closed, then this task is cancelled.
+// If ctx has been cancelled then the task is not run and the error from ctx is
+// returned.
 func doTask(
+	ctx context.Context,
 	args Args,
 	id int64,
 	task func(Args, int64) error,
-	done <-chan struct{},
 ) error {
 
-	select {
-	case <-done:
-		return fmt.Errorf("task cancelled")
-	default:
-		if id == 0 {
-			return fmt.Errorf("id zero")
-		}
-		return task(args, id)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if id == 0 {
+		return fmt.Errorf("id zero")
 	}
+	return task(args, id)
 }
@@ -0,0 +1,173 @@
+package conc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunTasksRunsEveryTask(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     int
+		gophers int
+	}{
+		{"no tasks", 0, 4},
+		{"fewer gophers than tasks", 100, 4},
+		{"more gophers than tasks", 3, 50},
+		{"no gophers", 10, 0},
+	}
+
+	for _, test := range tests {
+		ids := []int64{}
+		for i := 1; i <= test.ids; i++ {
+			ids = append(ids, int64(i))
+		}
+
+		var (
+			seen     = map[int64]int{}
+			seenLock sync.Mutex
+		)
+		errs := RunTasks(
+			context.Background(),
+			ids,
+			Args{},
+			func(args Args, id int64) error {
+				seenLock.Lock()
+				seen[id]++
+				seenLock.Unlock()
+				return nil
+			},
+			test.gophers,
+		)
+
+		if len(errs) > 0 {
+			t.Errorf("%s: expected no errors, got %v", test.name, errs)
+		}
+		if len(seen) != test.ids {
+			t.Errorf("%s: expected %d tasks to run, %d ran", test.name, test.ids, len(seen))
+		}
+		for id, n := range seen {
+			if n != 1 {
+				t.Errorf("%s: task %d ran %d times", test.name, id, n)
+			}
+		}
+	}
+}
+
+func TestRunTasksRejectsZeroID(t *testing.T) {
+	var ran int64
+	errs := RunTasks(
+		context.Background(),
+		[]int64{1, 0, 2},
+		Args{ContinueOnError: true},
+		func(args Args, id int64) error {
+			atomic.AddInt64(&ran, 1)
+			return nil
+		},
+		1,
+	)
+
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %v", errs)
+	}
+	taskErr, ok := errs[0].(TaskError)
+	if !ok || taskErr.ID != 0 {
+		t.Errorf("Expected a TaskError for ID 0, got %v", errs[0])
+	}
+	if ran != 2 {
+		t.Errorf("Expected 2 tasks to run, %d ran", ran)
+	}
+}
+
+func TestRunTasksStopsOnError(t *testing.T) {
+	ids := []int64{}
+	for i := int64(1); i <= 1000; i++ {
+		ids = append(ids, i)
+	}
+
+	failed := errors.New("failed")
+	var ran int64
+	errs := RunTasks(
+		context.Background(),
+		ids,
+		Args{},
+		func(args Args, id int64) error {
+			atomic.AddInt64(&ran, 1)
+			if id == 10 {
+				return failed
+			}
+			return nil
+		},
+		4,
+	)
+
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %v", errs)
+	}
+	if taskErr, ok := errs[0].(TaskError); !ok || taskErr.Err != failed {
+		t.Errorf("Expected the TaskError of ID 10, got %v", errs[0])
+	}
+	if n := atomic.LoadInt64(&ran); n == int64(len(ids)) {
+		t.Error("Expected the error to stop the tasks that remain")
+	}
+}
+
+func TestRunTasksCancelled(t *testing.T) {
+	ids := []int64{}
+	for i := int64(1); i <= 1000; i++ {
+		ids = append(ids, i)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ran int64
+	errs := RunTasks(
+		ctx,
+		ids,
+		Args{},
+		func(args Args, id int64) error {
+			if atomic.AddInt64(&ran, 1) == 5 {
+				cancel()
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		},
+		4,
+	)
+
+	if len(errs) != 1 || errs[0] != context.Canceled {
+		t.Errorf("Expected only the cancellation error, got %v", errs)
+	}
+
+	// The tasks in progress when cancelled are allowed to finish, but no more
+	// are started
+	if n := atomic.LoadInt64(&ran); n > 5+4 {
+		t.Errorf("Expected no tasks to start once cancelled, %d ran", n)
+	}
+}
+
+func TestRunTaskStreamReturnsProducerError(t *testing.T) {
+	failed := errors.New("failed")
+	errs := RunTaskStream(
+		context.Background(),
+		func(ctx context.Context, ids chan<- int64) error {
+			ids <- 1
+			return failed
+		},
+		0,
+		Args{},
+		func(args Args, id int64) error {
+			return nil
+		},
+		4,
+	)
+
+	if len(errs) != 1 || errs[0] != failed {
+		t.Errorf("Expected the error of the producer, got %v", errs)
+	}
+}
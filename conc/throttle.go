@@ -0,0 +1,193 @@
+package conc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How often the throttle reconsiders the number of gophers that may run, and
+// how long a paused gopher waits before checking whether it may run again
+const (
+	adjustInterval = time.Second
+	pauseInterval  = 100 * time.Millisecond
+)
+
+// throttle limits the gophers in RunTasks so that an import can run against a
+// live site. It measures how long each task takes, and as each task is little
+// more than a few database queries a rising latency means that the database is
+// struggling. When the average latency is above the target the number of
+// gophers that may run is reduced, and when it is well below the target the
+// number is increased again up to the number RunTasks was given.
+//
+// Independently of latency, the rate at which tasks start can be capped.
+type throttle struct {
+	targetLatency time.Duration
+	interval      time.Duration
+
+	sync.Mutex
+	max        int
+	allowed    int
+	average    time.Duration
+	nextStart  time.Time
+	lastAdjust time.Time
+}
+
+// newThrottle returns a throttle for the given number of gophers. A zero
+// targetLatency disables the adaptation and a zero maxPerSecond disables the
+// cap on the rate.
+func newThrottle(
+	gophers int,
+	targetLatency time.Duration,
+	maxPerSecond int64,
+) *throttle {
+
+	t := &throttle{
+		targetLatency: targetLatency,
+		max:           gophers,
+		allowed:       gophers,
+		lastAdjust:    time.Now(),
+	}
+	if maxPerSecond > 0 {
+		t.interval = time.Second / time.Duration(maxPerSecond)
+	}
+
+	return t
+}
+
+// wait blocks the given gopher until it may start another task. It returns
+// false if ctx is cancelled whilst waiting, or if drained is closed whilst the
+// gopher is paused as there are no more tasks for it.
+func (t *throttle) wait(
+	ctx context.Context,
+	drained <-chan struct{},
+	gopher int,
+) bool {
+
+	// Gophers beyond the number allowed are paused. The first gopher is never
+	// paused, so the import always makes progress. The number allowed is only
+	// adjusted as tasks finish, so a paused gopher must also stop once every
+	// task has been taken by the others.
+	for {
+		t.Lock()
+		allowed := t.allowed
+		t.Unlock()
+
+		if gopher < allowed {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-drained:
+			return false
+		case <-time.After(pauseInterval):
+		}
+	}
+
+	if t.interval == 0 {
+		return ctx.Err() == nil
+	}
+
+	// Reserve the next slot in which a task may start
+	t.Lock()
+	now := time.Now()
+	start := t.nextStart
+	if start.Before(now) {
+		start = now
+	}
+	t.nextStart = start.Add(t.interval)
+	t.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(start.Sub(now)):
+		return true
+	}
+}
+
+// observe records how long a task took and adjusts the number of gophers
+// allowed to run if the average has drifted from the target.
+func (t *throttle) observe(latency time.Duration) {
+	if t.targetLatency == 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	// Exponentially weighted, so that a single slow task does not throttle
+	// everything but a sustained slowdown is reacted to within a few tasks
+	if t.average == 0 {
+		t.average = latency
+	} else {
+		t.average = (t.average*4 + latency) / 5
+	}
+
+	if time.Since(t.lastAdjust) < adjustInterval {
+		return
+	}
+	t.lastAdjust = time.Now()
+
+	allowed := t.allowed
+	switch {
+	case t.average > t.targetLatency*2:
+		// Struggling, back off quickly
+		allowed = allowed / 2
+
+	case t.average > t.targetLatency:
+		allowed--
+
+	case t.average < t.targetLatency/2:
+		// Idle, recover slowly
+		allowed++
+	}
+
+	if allowed < 1 {
+		allowed = 1
+	}
+	if allowed > t.max {
+		allowed = t.max
+	}
+
+	if allowed != t.allowed {
+		glog.Infof(
+			"Throttling from %d to %d gophers, average latency %s",
+			t.allowed,
+			allowed,
+			t.average,
+		)
+		t.allowed = allowed
+	}
+}
+
+// LatencyMeter passes the latencies of writes made on behalf of tasks to the
+// throttle of the RunTasks that is running the tasks, see Args.Latency. It is
+// safe for concurrent use, and latencies observed whilst RunTasks is not
+// running are ignored.
+type LatencyMeter struct {
+	sync.Mutex
+	t *throttle
+}
+
+// Observe records how long writing a single item took
+func (m *LatencyMeter) Observe(latency time.Duration) {
+	m.Lock()
+	t := m.t
+	m.Unlock()
+
+	if t != nil {
+		t.observe(latency)
+	}
+}
+
+// attach sets the throttle that latencies are passed to, nil detaching it
+func (m *LatencyMeter) attach(t *throttle) {
+	m.Lock()
+	m.t = t
+	m.Unlock()
+}
@@ -0,0 +1,119 @@
+package conc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitStopsPausedGopherWhenDrained(t *testing.T) {
+	th := newThrottle(4, time.Millisecond, 0)
+	th.allowed = 1
+
+	drained := make(chan struct{})
+	close(drained)
+
+	done := make(chan bool)
+	go func() {
+		done <- th.wait(context.Background(), drained, 3)
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Expected a paused gopher not to run once drained")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Paused gopher is still waiting after the tasks were drained")
+	}
+}
+
+func TestWaitStopsPausedGopherWhenCancelled(t *testing.T) {
+	th := newThrottle(4, time.Millisecond, 0)
+	th.allowed = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if th.wait(ctx, make(chan struct{}), 3) {
+		t.Error("Expected a paused gopher not to run once cancelled")
+	}
+}
+
+func TestWaitRunsAllowedGopher(t *testing.T) {
+	th := newThrottle(4, time.Millisecond, 0)
+	th.allowed = 2
+
+	if !th.wait(context.Background(), make(chan struct{}), 1) {
+		t.Error("Expected an allowed gopher to run")
+	}
+}
+
+// The tasks are slow enough that the throttle pauses half of the gophers after
+// adjustInterval, and those gophers must not stop RunTasks from returning once
+// the tasks run out
+func TestRunTasksFinishesWhenThrottled(t *testing.T) {
+	ids := []int64{}
+	for i := int64(1); i <= 200; i++ {
+		ids = append(ids, i)
+	}
+
+	var ran int64
+	args := Args{
+		ContinueOnError: true,
+		TargetLatency:   time.Nanosecond,
+	}
+
+	done := make(chan []error)
+	go func() {
+		done <- RunTasks(
+			context.Background(),
+			ids,
+			args,
+			func(args Args, id int64) error {
+				atomic.AddInt64(&ran, 1)
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			},
+			8,
+		)
+	}()
+
+	select {
+	case errs := <-done:
+		if len(errs) > 0 {
+			t.Errorf("Expected no errors, got %v", errs)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("RunTasks did not return once throttled")
+	}
+
+	if n := atomic.LoadInt64(&ran); n != int64(len(ids)) {
+		t.Errorf("Expected %d tasks to run, %d ran", len(ids), n)
+	}
+}
+
+func TestLatencyMeterObservesOnlyWhenAttached(t *testing.T) {
+	th := newThrottle(4, time.Millisecond, 0)
+	th.lastAdjust = time.Time{}
+
+	m := &LatencyMeter{}
+	m.Observe(time.Second)
+	if th.allowed != 4 {
+		t.Fatalf("Expected a detached meter not to throttle, allowed = %d", th.allowed)
+	}
+
+	m.attach(th)
+	m.Observe(time.Second)
+	if th.allowed != 2 {
+		t.Errorf("Expected a slow write to halve the gophers, allowed = %d", th.allowed)
+	}
+
+	m.attach(nil)
+	th.lastAdjust = time.Time{}
+	m.Observe(time.Second)
+	if th.allowed != 2 {
+		t.Errorf("Expected a detached meter not to throttle, allowed = %d", th.allowed)
+	}
+}
@@ -1,10 +1,34 @@
 package config
 
+import (
+	"time"
+)
+
+const (
+	configFile               = "config.toml"
+	configExportSection      = "export"
+	configSiteSection        = "site"
+	configDatabaseSection    = "database"
+	configConcurrencySection = "concurrency"
+)
+
+// The values of ForumConflict
+const (
+	ForumConflictCreate = "create"
+	ForumConflictRename = "rename"
+	ForumConflictMerge  = "merge"
+)
+
+// The values of ForumFallbackOwner
+const (
+	ForumFallbackOwnerSiteOwner = "site_owner"
+	ForumFallbackOwnerDeleted   = "deleted"
+)
+
+// The values of IDStore
 const (
-	configFile            = "config.toml"
-	configExportSection   = "export"
-	configSiteSection     = "site"
-	configDatabaseSection = "database"
+	IDStoreMemory = "memory"
+	IDStoreDisk   = "disk"
 )
 
 var (
@@ -46,4 +70,68 @@ var (
 	// Rootpath is the relative or absolute path to the directory that contains
 	// the exported data that we are importing
 	Rootpath string
+
+	// Source identifies the forum that the export came from, so that exports
+	// from several forums can be imported into one site. Defaults to SiteName.
+	Source string
+
+	// ForumConflict is what happens when a forum has the same name as a
+	// microcosm that already exists on the site: 'create' another microcosm
+	// with the same name, 'rename' the forum by appending the Source, or
+	// 'merge' the forum into the existing microcosm
+	ForumConflict string
+
+	// ForumFlattenDepth is the deepest that forums are nested as microcosms,
+	// forums below it become children of their ancestor at the depth above.
+	// 1 imports every forum as a top level microcosm, and 0 keeps the whole
+	// hierarchy.
+	ForumFlattenDepth int64
+
+	// ForumFallbackOwner is who owns the microcosm of a forum whose author was
+	// not imported: 'site_owner' for the owner of the site, or 'deleted' for
+	// the profile that owns orphaned content
+	ForumFallbackOwner string
+
+	// OldHostnames are the hostnames of the forum that the export came from,
+	// links to which are rewritten to link to the imported items instead
+	OldHostnames []string
+
+	// IDStore is where the maps of old to new IDs are kept: 'memory', which
+	// loads every prior import when resuming, or 'disk', which keeps them in a
+	// file per origin in the Rootpath and reads them as needed
+	IDStore string
+
+	// Gophers contains the number of items of each type to import concurrently,
+	// keyed by the item type name, i.e. 'comment'. Item types that are absent
+	// use a default.
+	Gophers = map[string]int64{}
+
+	// MaxConnections is a ceiling on the number of open database connections,
+	// and so on the number of gophers for any item type, as we need to be able
+	// to run on a live site without breaking it. The gophers are allowed
+	// ReservedConnections fewer than this. 0 means no ceiling.
+	MaxConnections int64
+
+	// TargetLatency is how long importing a single item should take when the
+	// database is not struggling, fewer gophers are used when items take longer
+	// than this. 0 disables throttling on latency.
+	TargetLatency time.Duration
+
+	// MaxItemsPerSecond caps the rate at which items of each type are imported.
+	// 0 means no cap.
+	MaxItemsPerSecond int64
+
+	// CommentBatchSize is the number of comments written to the database in a
+	// single transaction. 0 writes each comment on its own.
+	CommentBatchSize int64
 )
+
+// ReservedConnections are the connections under MaxConnections that gophers
+// cannot take. A gopher within a transaction may need a second connection, as
+// may the comment batch writer and the queries of the throttle whilst every
+// gopher holds one, and without these they would wait on each other forever.
+const ReservedConnections = 2
+
+// MaxCommentBatchSize keeps the parameters of the statements that write a
+// batch of comments within the limit of PostgreSQL
+const MaxCommentBatchSize = 1000
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/golang/glog"
 
 	"github.com/microcosm-cc/goconfig"
+	h "github.com/microcosm-cc/microcosm/helpers"
 )
 
 func init() {
@@ -64,4 +70,168 @@ func init() {
 	if err != nil {
 		glog.Fatal(err)
 	}
+
+	Source = SiteName
+	if conf.HasOption(configExportSection, "source") {
+		Source, err = conf.GetString(configExportSection, "source")
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	ForumConflict = ForumConflictCreate
+	if conf.HasOption(configExportSection, "forum_conflict") {
+		ForumConflict, err = conf.GetString(configExportSection, "forum_conflict")
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	switch ForumConflict {
+	case ForumConflictCreate, ForumConflictRename, ForumConflictMerge:
+	default:
+		glog.Fatalf("Unknown forum_conflict: %s", ForumConflict)
+	}
+
+	if conf.HasOption(configExportSection, "forum_flatten_depth") {
+		ForumFlattenDepth, err = conf.GetInt64(
+			configExportSection,
+			"forum_flatten_depth",
+		)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if ForumFlattenDepth < 0 {
+			glog.Fatalf("Invalid forum_flatten_depth: %d", ForumFlattenDepth)
+		}
+	}
+
+	ForumFallbackOwner = ForumFallbackOwnerSiteOwner
+	if conf.HasOption(configExportSection, "forum_fallback_owner") {
+		ForumFallbackOwner, err = conf.GetString(
+			configExportSection,
+			"forum_fallback_owner",
+		)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	switch ForumFallbackOwner {
+	case ForumFallbackOwnerSiteOwner, ForumFallbackOwnerDeleted:
+	default:
+		glog.Fatalf("Unknown forum_fallback_owner: %s", ForumFallbackOwner)
+	}
+
+	if conf.HasOption(configExportSection, "old_hostnames") {
+		hostnames, err := conf.GetString(configExportSection, "old_hostnames")
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		for _, hostname := range strings.Split(hostnames, ",") {
+			hostname = strings.ToLower(strings.TrimSpace(hostname))
+			if hostname != "" {
+				OldHostnames = append(OldHostnames, hostname)
+			}
+		}
+	}
+
+	IDStore = IDStoreMemory
+	if conf.HasOption(configExportSection, "id_store") {
+		IDStore, err = conf.GetString(configExportSection, "id_store")
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	switch IDStore {
+	case IDStoreMemory, IDStoreDisk:
+	default:
+		glog.Fatalf("Unknown id_store: %s", IDStore)
+	}
+
+	// Concurrency config, which is optional.
+	if conf.HasSection(configConcurrencySection) {
+		options, err := conf.GetOptions(configConcurrencySection)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		for _, option := range options {
+			value, err := conf.GetInt64(configConcurrencySection, option)
+			if err != nil {
+				glog.Fatal(err)
+			}
+
+			switch option {
+			case "max_connections":
+				if value < 0 || (value > 0 && value <= ReservedConnections) {
+					glog.Fatalf(
+						"max_connections must be 0 or more than %d",
+						ReservedConnections,
+					)
+				}
+				MaxConnections = value
+				continue
+			case "target_latency_ms":
+				TargetLatency = time.Duration(value) * time.Millisecond
+				continue
+			case "max_items_per_second":
+				MaxItemsPerSecond = value
+				continue
+			case "comment_batch_size":
+				if value < 0 || value > MaxCommentBatchSize {
+					glog.Fatalf(
+						"comment_batch_size must be between 0 and %d",
+						MaxCommentBatchSize,
+					)
+				}
+				CommentBatchSize = value
+				continue
+			}
+
+			err = setGophers(option, value)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+	}
+}
+
+// OverrideGophers overrides the configured gophers for item types with those
+// from a comma separated list of itemType=gophers, i.e. "comment=10,profile=1"
+func OverrideGophers(overrides string) error {
+	if overrides == "" {
+		return nil
+	}
+
+	for _, override := range strings.Split(overrides, ",") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Expected itemType=gophers, got: %s", override)
+		}
+
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		err = setGophers(strings.TrimSpace(parts[0]), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setGophers(itemType string, value int64) error {
+	if _, ok := h.ItemTypes[itemType]; !ok {
+		return fmt.Errorf("Unknown item type for concurrency: %s", itemType)
+	}
+	if value < 1 {
+		return fmt.Errorf("Gophers for %s must be at least 1", itemType)
+	}
+
+	Gophers[itemType] = value
+
+	return nil
 }
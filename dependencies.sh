@@ -1,2 +1,3 @@
+go get -u github.com/boltdb/bolt
 go get -u github.com/cheggaaa/pb
 go get -u github.com/golang/glog
\ No newline at end of file
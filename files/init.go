@@ -1,13 +0,0 @@
-package files
-
-func init() {
-	// All of these are in maps.go
-	attachmentIDsToPaths = map[int64]string{}
-	commentIDsToPaths = map[int64]string{}
-	conversationIDsToPaths = map[int64]string{}
-	huddleIDsToPaths = map[int64]string{}
-	microcosmIDsToPaths = map[int64]string{}
-	profileIDsToPaths = map[int64]string{}
-	roleIDsToPaths = map[int64]string{}
-	watcherIDsToPaths = map[int64]string{}
-}
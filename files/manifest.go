@@ -0,0 +1,52 @@
+package files
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ManifestFile is the name of the file in the export root that describes the
+// source of the export
+const ManifestFile = "manifest.json"
+
+// Manifest describes the forum software that an export came from
+type Manifest struct {
+	Product      string    `json:"product"`
+	MajorVersion int64     `json:"majorVersion"`
+	MinorVersion int64     `json:"minorVersion"`
+	Exported     time.Time `json:"exported"`
+}
+
+func (m Manifest) String() string {
+	return fmt.Sprintf("%s %d.%d", m.Product, m.MajorVersion, m.MinorVersion)
+}
+
+// LoadManifest reads the manifest from the export root. Exports that pre-date
+// the manifest were all made from vBulletin 3.8, so that is presumed when there
+// is no manifest.
+func LoadManifest(rootPath string) (Manifest, error) {
+	manifestFile := path.Join(rootPath, ManifestFile)
+	if !Exists(manifestFile) {
+		glog.Warningf("No %s in export, presuming vBulletin 3.8", ManifestFile)
+		return Manifest{
+			Product:      "vbulletin",
+			MajorVersion: 3,
+			MinorVersion: 8,
+		}, nil
+	}
+
+	m := Manifest{}
+	err := JSONFileToInterface(manifestFile, &m)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	if m.Product == "" {
+		return Manifest{}, fmt.Errorf("%s does not name a product", ManifestFile)
+	}
+
+	return m, nil
+}
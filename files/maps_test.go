@@ -0,0 +1,195 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+func TestAddPathAndGetPath(t *testing.T) {
+	// The given ID differs for every item type. All of the paths are added
+	// before any are looked up, so that item types sharing a map would be
+	// noticed.
+	givenID := func(i int) int64 { return 42 + int64(i) }
+
+	tests := []struct {
+		name   string
+		dirs   []string
+		id     func(i int) int64
+		wantID func(i int) int64
+	}{
+		{
+			"parsed from the path",
+			[]string{"321", "231", "1.json"},
+			func(int) int64 { return 0 },
+			func(int) int64 { return 3212311 },
+		},
+		{
+			"parsed from a short path",
+			[]string{"7.json"},
+			func(int) int64 { return 0 },
+			func(int) int64 { return 7 },
+		},
+		{"given", []string{"elsewhere", "8.json"}, givenID, givenID},
+	}
+
+	pathOf := func(it *registry.ItemType, dirs []string) string {
+		return path.Join(append([]string{"/export", it.ExportPath}, dirs...)...)
+	}
+
+	for i, it := range registry.All() {
+		for _, test := range tests {
+			err := addPath(it.ID, pathOf(it, test.dirs), test.id(i))
+			if err != nil {
+				t.Fatalf("%s %s: failed to add path: %+v", it.Name, test.name, err)
+			}
+		}
+	}
+
+	for i, it := range registry.All() {
+		for _, test := range tests {
+			name := pathOf(it, test.dirs)
+			wantID := test.wantID(i)
+
+			if got := GetPath(it.ID, wantID); got != name {
+				t.Errorf(
+					"%s %s: GetPath(%d) = %q, want %q",
+					it.Name,
+					test.name,
+					wantID,
+					got,
+					name,
+				)
+			}
+		}
+
+		for j, other := range registry.All() {
+			if j == i {
+				continue
+			}
+			if got := GetPath(other.ID, givenID(i)); got != "" {
+				t.Errorf(
+					"%s: GetPath(%d) of %s = %q, want \"\"",
+					other.Name,
+					givenID(i),
+					it.Name,
+					got,
+				)
+			}
+		}
+
+		if got := GetPath(it.ID, 999999999); got != "" {
+			t.Errorf("%s: GetPath of an unknown ID = %q, want \"\"", it.Name, got)
+		}
+
+		// Paths that are not of an ID are skipped
+		err := addPath(
+			it.ID,
+			path.Join("/export", it.ExportPath, "index-old.json"),
+			0,
+		)
+		if err != nil {
+			t.Errorf("%s: expected a bad path to be skipped, got %+v", it.Name, err)
+		}
+
+		ids, err := GetIDs(it.ID)
+		if err != nil {
+			t.Fatalf("%s: failed to get IDs: %+v", it.Name, err)
+		}
+		want := []int64{7, givenID(i), 3212311}
+		if len(ids) != len(want) {
+			t.Fatalf("%s: GetIDs = %v, want %v", it.Name, ids, want)
+		}
+		for k := range want {
+			if ids[k] != want[k] {
+				t.Errorf("%s: GetIDs = %v, want %v", it.Name, ids, want)
+				break
+			}
+		}
+	}
+}
+
+func TestUnregisteredItemType(t *testing.T) {
+	const itemTypeID int64 = -1
+
+	if err := addPath(itemTypeID, "/export/x/1.json", 0); err == nil {
+		t.Error("Expected an error adding the path of an unregistered item type")
+	}
+	if got := GetPath(itemTypeID, 1); got != "" {
+		t.Errorf("GetPath = %q, want \"\"", got)
+	}
+	if _, err := GetIDs(itemTypeID); err == nil {
+		t.Error("Expected an error getting the IDs of an unregistered item type")
+	}
+}
+
+func TestGetPathDerived(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	for _, it := range registry.All() {
+		name, err := DerivePath(rootPath, it.ID, 4567)
+		if err != nil {
+			t.Fatalf("%s: failed to derive path: %+v", it.Name, err)
+		}
+		want := path.Join(rootPath, it.ExportPath, "456", "7.json")
+		if name != want {
+			t.Errorf("%s: DerivePath = %q, want %q", it.Name, name, want)
+		}
+
+		err = os.MkdirAll(path.Dir(name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(name, []byte("{}"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := GetPath(it.ID, 4567); got != "" {
+			t.Errorf("%s: GetPath before DeriveRoot = %q, want \"\"", it.Name, got)
+		}
+
+		DeriveRoot(rootPath, it.ID)
+
+		if got := GetPath(it.ID, 4567); got != name {
+			t.Errorf("%s: GetPath = %q, want %q", it.Name, got, name)
+		}
+		if got := GetPath(it.ID, 4568); got != "" {
+			t.Errorf("%s: GetPath of a missing file = %q, want \"\"", it.Name, got)
+		}
+	}
+}
+
+func TestStreamIDsSkipsStrayFiles(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	for _, it := range registry.All() {
+		dir := path.Join(rootPath, it.ExportPath, "123")
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"4.json", "4 (1).json", "notes.txt"} {
+			err = ioutil.WriteFile(path.Join(dir, name), []byte("{}"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		count, err := CountIDs(rootPath, it.ID)
+		if err != nil || count != 1 {
+			t.Errorf("%s: CountIDs = %d, %v, want 1", it.Name, count, err)
+		}
+	}
+}
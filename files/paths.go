@@ -1,44 +1,27 @@
 package files
 
 import (
-	"github.com/golang/glog"
+	"path"
 
-	src "github.com/microcosm-cc/export-schemas/go/forum"
-	h "github.com/microcosm-cc/microcosm/helpers"
+	"github.com/microcosm-cc/import-schemas/registry"
 )
 
-func getPathForItemType(itemTypeID int64) string {
-	var path string
-
-	switch itemTypeID {
-
-	case h.ItemTypes[h.ItemTypeProfile]:
-		path = src.ProfilesPath
-
-	case h.ItemTypes[h.ItemTypeAttachment]:
-		path = src.AttachmentsPath
-
-	case h.ItemTypes[h.ItemTypeComment]:
-		path = src.CommentsPath
-
-	case h.ItemTypes[h.ItemTypeConversation]:
-		path = src.ConversationsPath
-
-	case h.ItemTypes[h.ItemTypeWatcher]:
-		path = src.FollowsPath
-
-	case h.ItemTypes[h.ItemTypeHuddle]:
-		path = src.MessagesPath
-
-	case h.ItemTypes[h.ItemTypeMicrocosm]:
-		path = src.ForumsPath
+func getPathForItemType(itemTypeID int64) (string, error) {
+	it, err := registry.Get(itemTypeID)
+	if err != nil {
+		return "", err
+	}
 
-	case h.ItemTypes[h.ItemTypeRole]:
-		path = src.RolesPath
+	return it.ExportPath, nil
+}
 
-	default:
-		glog.Fatal("Not yet implemented")
+// ExportExists reports whether the export at rootPath contains a subdirectory
+// for the given itemTypeID
+func ExportExists(rootPath string, itemTypeID int64) bool {
+	exportPath, err := getPathForItemType(itemTypeID)
+	if err != nil {
+		return false
 	}
 
-	return path
+	return Exists(path.Join(rootPath, exportPath))
 }
@@ -0,0 +1,244 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+)
+
+// The number of digits of an ID used for each directory of an export
+const digitsPerDir = 3
+
+// DerivePath returns the path that export-schemas writes an item to, which is
+// determined by its ID. i.e. for the comment with the ID 3212311 the path is:
+// comments/321/231/1.json
+func DerivePath(
+	rootPath string,
+	itemTypeID int64,
+	itemID int64,
+) (
+	string,
+	error,
+) {
+	exportPath, err := getPathForItemType(itemTypeID)
+	if err != nil {
+		return "", err
+	}
+
+	id := strconv.FormatInt(itemID, 10)
+
+	parts := []string{rootPath, exportPath}
+	for len(id) > digitsPerDir {
+		parts = append(parts, id[:digitsPerDir])
+		id = id[digitsPerDir:]
+	}
+	parts = append(parts, id+".json")
+
+	return path.Join(parts...), nil
+}
+
+// DeriveRoot has GetPath derive the paths of the items of the given type that
+// it has not been told of from their IDs, as the paths of streamed items are
+// not held in memory. StreamIDs calls it, but it must also be called before
+// the paths of items of the type are needed without streaming them, such as
+// when retrying failures.
+func DeriveRoot(rootPath string, itemTypeID int64) {
+	derivedRootsLock.Lock()
+	derivedRoots[itemTypeID] = rootPath
+	derivedRootsLock.Unlock()
+}
+
+// StreamIDs sends the ID of every item of the given type in the export to ids.
+// The IDs are read from the index.json when there is one, in the order of the
+// index, and otherwise from a walk of the directory tree, in lexical order of
+// the paths. Unlike WalkExportTree the paths are not held in memory, as
+// GetPath is able to derive them from the IDs. Only paths that differ from
+// those that would be derived are remembered.
+//
+// If ctx is cancelled then the error from ctx is returned.
+func StreamIDs(
+	ctx context.Context,
+	rootPath string,
+	itemTypeID int64,
+	ids chan<- int64,
+) error {
+
+	DeriveRoot(rootPath, itemTypeID)
+
+	return streamIDs(
+		ctx,
+		rootPath,
+		itemTypeID,
+		func(id int64, name string) error {
+			derived, err := DerivePath(rootPath, itemTypeID, id)
+			if err != nil {
+				return err
+			}
+			if name != derived {
+				err = addPath(itemTypeID, name, id)
+				if err != nil {
+					return err
+				}
+			}
+
+			select {
+			case ids <- id:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	)
+}
+
+// CountIDs returns the number of items of the given type in the export without
+// holding their IDs or paths in memory
+func CountIDs(rootPath string, itemTypeID int64) (int64, error) {
+	var count int64
+	err := streamIDs(
+		context.Background(),
+		rootPath,
+		itemTypeID,
+		func(id int64, name string) error {
+			count++
+			return nil
+		},
+	)
+
+	return count, err
+}
+
+// streamIDs calls found with the ID and path of every item of the given type
+// in the export
+func streamIDs(
+	ctx context.Context,
+	rootPath string,
+	itemTypeID int64,
+	found func(id int64, name string) error,
+) error {
+
+	exportPath, err := getPathForItemType(itemTypeID)
+	if err != nil {
+		return err
+	}
+
+	indexFile := path.Join(rootPath, exportPath, "index.json")
+	if Exists(indexFile) {
+		return streamIndex(rootPath, indexFile, found)
+	}
+
+	return filepath.Walk(
+		path.Join(rootPath, exportPath),
+		func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if info.IsDir() || filepath.Ext(name) != ".json" {
+				return nil
+			}
+
+			// Stray files, such as editor backups, are skipped as they are by
+			// addPath
+			id, err := parseID(itemTypeID, name)
+			if err != nil {
+				glog.Errorf("Failed to parseInt %s %+v", name, err)
+				return nil
+			}
+
+			return found(id, name)
+		},
+	)
+}
+
+// streamIndex decodes the files of an index.json one at a time, rather than
+// the whole index at once
+func streamIndex(
+	rootPath string,
+	indexFile string,
+	found func(id int64, name string) error,
+) error {
+
+	f, err := os.Open(indexFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+
+	err = expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if key, ok := token.(string); !ok || key != "files" {
+			// Skip the value of anything other than the files
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = expectDelim(dec, '[')
+		if err != nil {
+			return err
+		}
+
+		for dec.More() {
+			df := src.DirFile{}
+			err = dec.Decode(&df)
+			if err != nil {
+				return err
+			}
+
+			err = found(
+				df.ID,
+				path.Join(rootPath, strings.Replace(df.Path, `//`, `/`, -1)),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = expectDelim(dec, ']')
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("Expected %s in index but got %v", delim, token)
+	}
+
+	return nil
+}
@@ -19,15 +19,20 @@ import (
 //   [3213211]"comments/321/321/1.json"
 // and so on for all paths within the directory structure
 func WalkExportTree(rootPath string, itemTypeID int64) error {
-	indexFile := path.Join(rootPath, getPathForItemType(itemTypeID), "index.json")
+	exportPath, err := getPathForItemType(itemTypeID)
+	if err != nil {
+		return err
+	}
+
+	indexFile := path.Join(rootPath, exportPath, "index.json")
 	if Exists(indexFile) {
 		return loadIndex(rootPath, indexFile, itemTypeID)
 	}
 
-	return doWalk(rootPath, itemTypeID)
+	return doWalk(rootPath, exportPath, itemTypeID)
 }
 
-func doWalk(rootPath string, itemTypeID int64) error {
+func doWalk(rootPath string, exportPath string, itemTypeID int64) error {
 	glog.Info("Walking tree")
 	// Define what should be done in the subsequent directory walk.
 	walk := func(path string, info os.FileInfo, err error) error {
@@ -37,7 +42,7 @@ func doWalk(rootPath string, itemTypeID int64) error {
 		}
 
 		if filepath.Ext(path) == ".json" {
-			addPath(itemTypeID, path, 0)
+			return addPath(itemTypeID, path, 0)
 		}
 
 		return nil
@@ -45,7 +50,7 @@ func doWalk(rootPath string, itemTypeID int64) error {
 
 	// Walk each path in the directory.
 	return filepath.Walk(
-		path.Join(rootPath, getPathForItemType(itemTypeID)),
+		path.Join(rootPath, exportPath),
 		walk,
 	)
 }
@@ -60,11 +65,14 @@ func loadIndex(rootPath string, indexFile string, itemTypeID int64) error {
 	}
 
 	for _, df := range dirIndex.Files {
-		addPath(
+		err = addPath(
 			itemTypeID,
 			path.Join(rootPath, strings.Replace(df.Path, `//`, `/`, -1)),
 			df.ID,
 		)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package imp
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -13,42 +14,41 @@ import (
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
 	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
-func importAttachments(args conc.Args, gophers int) (errors []error) {
+func importAttachments(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) (errors []error) {
 
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeAttachment]
 
 	fmt.Println("Loading attachments")
 	glog.Info("Loading attachments")
 
-	err := files.WalkExportTree(args.RootPath, args.ItemTypeID)
-	if err != nil {
-		exitWithError(err, []error{})
-	}
-
-	return conc.RunTasks(
-		files.GetIDs(args.ItemTypeID),
-		args,
-		importAttachment,
-		gophers,
-	)
+	return streamTasks(ctx, args, importAttachment, gophers)
 }
 
-func importAttachment(args conc.Args, itemID int64) error {
+func importAttachment(args Args, itemID int64) error {
 
 	// Attachment new ID is the PK from the attachments table.
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		if glog.V(2) {
 			glog.Infof("Skipping attachment %d\n", itemID)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
 	srcAttach := src.Attachment{}
-	err := files.JSONFileToInterface(
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&srcAttach,
 	)
@@ -91,19 +91,21 @@ func importAttachment(args conc.Args, itemID int64) error {
 	}
 	fm.FileHash = SHA1
 
-	max := int64(1)<<32 - 1
-	_, err = fm.Import(max, max)
+	err = args.Target.CreateFileMetadata(&fm)
 	if err != nil {
 		glog.Error(err)
 		return err
 	}
 
 	// Look up the author profile based on the old user ID.
-	authorID := accounting.GetNewID(
+	authorID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeProfile],
 		srcAttach.Author,
 	)
+	if err != nil {
+		return err
+	}
 	if authorID == 0 {
 		authorID = args.DeletedProfileID
 		if glog.V(2) {
@@ -121,25 +123,37 @@ func importAttachment(args conc.Args, itemID int64) error {
 		switch assoc.OnType {
 		case "comment":
 			assocItemTypeID = 4
-			assocItemID = accounting.GetNewID(
+			assocItemID, err = accounting.GetNewID(
 				args.OriginID,
 				h.ItemTypes[h.ItemTypeComment],
 				assoc.OnID,
 			)
+			if err != nil {
+				return err
+			}
 		case "profile":
 			assocItemTypeID = 3
-			assocItemID = accounting.GetNewID(
+			assocItemID, err = accounting.GetNewID(
 				args.OriginID,
 				h.ItemTypes[h.ItemTypeProfile],
 				assoc.OnID,
 			)
+			if err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("Unknown attachment association: %s\n", assoc.OnType)
 		}
 
 		if assocItemID == 0 {
 			// Skip this one
-			return fmt.Errorf("Attachment %d attached to something that doesn't exist\n", itemID)
+			err := fmt.Errorf("Attachment %d attached to something that doesn't exist\n", itemID)
+			if args.DryRun {
+				glog.Error(err)
+				accounting.RecordOutcome(args.ItemTypeID, accounting.Orphaned)
+				return nil
+			}
+			return err
 		}
 
 		at := models.AttachmentType{
@@ -151,36 +165,40 @@ func importAttachment(args conc.Args, itemID int64) error {
 			FileName:         srcAttach.Name,
 			Created:          srcAttach.DateCreated,
 		}
-		_, err = at.Import()
+		orphanID, err := beginCreate(args, srcAttach.ID, target.Orphan{
+			ItemTypeID:       args.ItemTypeID,
+			ParentItemTypeID: assocItemTypeID,
+			ParentID:         assocItemID,
+			CreatedByID:      authorID,
+			Created:          srcAttach.DateCreated,
+			FileMetaID:       fm.AttachmentMetaId,
+		})
 		if err != nil {
-			glog.Errorf("Could not import attachment %d\n", srcAttach.ID)
 			return err
 		}
 
-		tx, err := h.GetTransaction()
-		if err != nil {
-			return err
+		if orphanID > 0 {
+			at.AttachmentId = orphanID
+		} else {
+			err = args.Target.CreateAttachment(&at)
+			if err != nil {
+				glog.Errorf("Could not import attachment %d\n", srcAttach.ID)
+				return err
+			}
 		}
-		defer tx.Rollback()
 
-		err = accounting.RecordImport(
-			tx,
+		err = args.Target.RecordImport(
 			args.OriginID,
 			args.ItemTypeID,
 			srcAttach.ID,
 			at.AttachmentMetaId,
 		)
 		if err != nil {
-			glog.Errorf("Failed to recordImport: %+v", err)
-			return err
-		}
-
-		err = tx.Commit()
-		if err != nil {
-			glog.Errorf("Failed to commit transaction: %+v", err)
 			return err
 		}
 	}
 
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
+
 	return nil
 }
@@ -0,0 +1,169 @@
+package imp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/conc"
+	"github.com/microcosm-cc/import-schemas/target"
+)
+
+// The longest that a comment waits for its batch to fill before the batch is
+// written anyway, as comments may be queued more slowly than the batches fill
+const commentBatchWait = 200 * time.Millisecond
+
+// commentBatch is set whilst comments are written in batches
+var commentBatch *commentBatcher
+
+// commentBatcher collects the comments of the tasks that import them so that
+// they are written to the database together by a single writer. A task returns
+// once its comment is queued, so that the number of gophers does not limit the
+// size of a batch and the time spent waiting for a batch to fill is not taken
+// as the latency of the database. Instead the time taken by each write is
+// recorded in args.Latency for the throttle. The comments that fail are
+// returned by close.
+type commentBatcher struct {
+	args     Args
+	size     int
+	comments chan *target.Comment
+	done     chan struct{}
+
+	sync.Mutex
+	errs []error
+}
+
+func newCommentBatcher(args Args, size int) *commentBatcher {
+	b := &commentBatcher{
+		args:     args,
+		size:     size,
+		comments: make(chan *target.Comment, size),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+
+	return b
+}
+
+// add queues the comment to be written as part of a batch. Unless the import
+// continues on error no more comments are queued once a comment has failed, so
+// that the import stops as it would had the comment been written by its task.
+func (b *commentBatcher) add(c *target.Comment) error {
+	if !b.args.ContinueOnError {
+		b.Lock()
+		failed := len(b.errs) > 0
+		b.Unlock()
+
+		if failed {
+			return fmt.Errorf("Comment %d not queued as a batch failed", c.OldID)
+		}
+	}
+
+	b.comments <- c
+
+	return nil
+}
+
+// close writes the comments that are still queued, and returns a TaskError for
+// each comment that could not be written
+func (b *commentBatcher) close() []error {
+	close(b.comments)
+	<-b.done
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.errs
+}
+
+// run writes the queued comments whenever a batch is full, or has waited for
+// long enough
+func (b *commentBatcher) run() {
+	defer close(b.done)
+
+	var (
+		batch []*target.Comment
+		wait  <-chan time.Time
+	)
+	for {
+		select {
+		case c, ok := <-b.comments:
+			if !ok {
+				b.write(batch)
+				return
+			}
+
+			batch = append(batch, c)
+			if len(batch) == 1 {
+				wait = time.After(commentBatchWait)
+			}
+			if len(batch) < b.size {
+				continue
+			}
+
+		case <-wait:
+		}
+
+		b.write(batch)
+		batch = nil
+		wait = nil
+	}
+}
+
+// write writes a batch and records the outcome of each comment. When the batch
+// cannot be written nothing of it has been, and so each comment is written on
+// its own so that only those that fail are failures.
+func (b *commentBatcher) write(batch []*target.Comment) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// A batch that cannot be written fails on its first statement to do so,
+	// and the time taken is not that of writing each comment
+	start := time.Now()
+	err := b.args.Target.CreateComments(b.args.SiteID, b.args.OriginID, batch)
+	if err == nil {
+		b.observe(time.Since(start) / time.Duration(len(batch)))
+
+		for range batch {
+			accounting.RecordOutcome(b.args.ItemTypeID, accounting.Created)
+		}
+		return
+	}
+
+	glog.Errorf(
+		"Failed to write a batch of %d comments, writing each on its own: %+v",
+		len(batch),
+		err,
+	)
+	for _, c := range batch {
+		start = time.Now()
+		err = createComment(b.args, c)
+		b.observe(time.Since(start))
+		if err == nil {
+			accounting.RecordOutcome(b.args.ItemTypeID, accounting.Created)
+			continue
+		}
+
+		// As in a dry run a failed task is a failure rather than an error
+		if b.args.DryRun {
+			glog.Errorf("Failed on ID %d : %+v", c.OldID, err)
+			accounting.RecordOutcome(b.args.ItemTypeID, accounting.Failed)
+			continue
+		}
+
+		b.Lock()
+		b.errs = append(b.errs, conc.TaskError{ID: c.OldID, Err: err})
+		b.Unlock()
+	}
+}
+
+// observe records how long writing a single comment took
+func (b *commentBatcher) observe(latency time.Duration) {
+	if b.args.Latency != nil {
+		b.args.Latency.Observe(latency)
+	}
+}
@@ -1,75 +1,80 @@
 package imp
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"strings"
-	"sync"
+	"time"
 
 	"github.com/golang/glog"
 
 	src "github.com/microcosm-cc/export-schemas/go/forum"
-	"github.com/microcosm-cc/microcosm/audit"
 	h "github.com/microcosm-cc/microcosm/helpers"
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
 	"github.com/microcosm-cc/import-schemas/conc"
+	"github.com/microcosm-cc/import-schemas/config"
 	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/markup"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
-var (
-	// map[oldCommentId]oldInReplyToId
-	commentReplies     = make(map[int64]int64)
-	commentRepliesLock = sync.Mutex{}
-
-	// a slice of oldCommentIds that we have imported *on this run*
-	commentsImportedThisRun = []int64{}
-)
-
-func importComments(args conc.Args, gophers int) []error {
+func importComments(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) []error {
 
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeComment]
 
-	err := files.WalkExportTree(args.RootPath, args.ItemTypeID)
-	if err != nil {
-		exitWithError(err, []error{})
-	}
-
 	// Import comments
 	fmt.Println("Importing comments...")
 	glog.Info("Importing comments...")
-	errs := conc.RunTasks(
-		files.GetIDs(args.ItemTypeID),
-		args,
-		importComment,
-		gophers,
-	)
 
-	// Process replies
-	if len(errs) == 0 && accounting.ThreadComments(args.OriginID) {
-		db, err := h.GetConnection()
-		if err != nil {
-			errs = append(errs, err)
-			return errs
-		}
+	if config.CommentBatchSize > 0 {
+		// The tasks only queue their comments, so the throttle is told how
+		// long the batches take to write
+		args.Latency = &conc.LatencyMeter{}
+		commentBatch = newCommentBatcher(args, int(config.CommentBatchSize))
+	}
+	errs := streamTasks(ctx, args, importComment, gophers)
+	if commentBatch != nil {
+		errs = append(errs, commentBatch.close()...)
+		commentBatch = nil
+	}
 
-		_, err = db.Exec(`
-UPDATE comments c
-   SET in_reply_to = i.item_id
-  FROM imported_items i
- WHERE i.origin_id = $1
-   AND i.item_type_id = 4
-   AND i.old_id::bigint = c.in_reply_to;`,
-			args.OriginID,
-		)
-		if err != nil {
-			errs = append(errs, err)
-			return errs
-		}
+	// Nothing was written, so there is nothing to thread or count
+	if args.DryRun {
+		return errs
+	}
 
-		accounting.ThreadedComments(args.OriginID)
+	// Thread the replies of this run, and of any earlier run whose replies
+	// were to comments that had not yet been imported
+	fmt.Println("Threading replies...")
+	glog.Info("Threading replies...")
+
+	threaded, invalid, unresolved, err := accounting.ThreadReplies(args.OriginID)
+	if err != nil {
+		errs = append(errs, err)
+		return errs
 	}
+	accounting.SetCommentsThreaded(args.OriginID, unresolved == 0)
+
+	fmt.Printf(
+		"Threaded %d replies, %d replied to a comment in another conversation "+
+			"and %d reply to comments that have not been imported\n",
+		threaded,
+		invalid,
+		unresolved,
+	)
+	glog.Infof(
+		"Threaded %d replies, %d replied to a comment in another conversation "+
+			"and %d reply to comments that have not been imported",
+		threaded,
+		invalid,
+		unresolved,
+	)
 
 	// Update comment counts for all users
 	_, err = models.UpdateCommentCountForAllProfiles(args.SiteID)
@@ -80,18 +85,23 @@ UPDATE comments c
 	return errs
 }
 
-func importComment(args conc.Args, itemID int64) error {
+func importComment(args Args, itemID int64) error {
 
 	// Skip if comment already imported.
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		if glog.V(2) {
 			glog.Infof("Skipping comment %d\n", itemID)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
 	srcComment := src.Comment{}
-	err := files.JSONFileToInterface(
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&srcComment,
 	)
@@ -101,11 +111,14 @@ func importComment(args conc.Args, itemID int64) error {
 	}
 
 	// Fetch new profile ID of comment author.
-	createdByID := accounting.GetNewID(
+	createdByID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeProfile],
 		srcComment.Author,
 	)
+	if err != nil {
+		return err
+	}
 	if createdByID == 0 {
 		createdByID = args.DeletedProfileID
 		if glog.V(2) {
@@ -116,12 +129,28 @@ func importComment(args conc.Args, itemID int64) error {
 		}
 	}
 
+	if len(srcComment.Versions) == 0 {
+		return fmt.Errorf("Comment %d has no versions", srcComment.ID)
+	}
+	revisions, err := commentRevisions(
+		args,
+		createdByID,
+		srcComment.DateCreated,
+		srcComment.Versions,
+	)
+	if err != nil {
+		return err
+	}
+
 	// Determine which new conversation ID this comment belongs to.
-	conversationID := accounting.GetNewID(
+	conversationID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeConversation],
 		srcComment.Association.OnID,
 	)
+	if err != nil {
+		return err
+	}
 	if conversationID == 0 {
 		if glog.V(2) {
 			glog.Infof(
@@ -131,6 +160,7 @@ func importComment(args conc.Args, itemID int64) error {
 				srcComment.ID,
 			)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Orphaned)
 		return nil
 	}
 
@@ -138,9 +168,9 @@ func importComment(args conc.Args, itemID int64) error {
 	m.ItemType = "conversation"
 	m.ItemId = conversationID
 
-	// This is garbage but will be corrected post-process
-	m.InReplyTo = srcComment.InReplyTo
-	m.Markdown = srcComment.Versions[0].Text
+	// Replies are threaded once the phase is complete, as the comment that
+	// this replies to may not have been imported yet
+	m.Markdown = revisions[len(revisions)-1].Markdown
 
 	m.Meta.Created = srcComment.DateCreated
 	m.Meta.CreatedById = createdByID
@@ -149,55 +179,154 @@ func importComment(args conc.Args, itemID int64) error {
 	m.Meta.Flags.Moderated = srcComment.Moderated
 	m.Meta.Flags.Visible = !srcComment.Deleted && !srcComment.Moderated
 
-	// Import creates and commits/rollbacks its own transaction.
-	_, err = m.Import(args.SiteID)
+	c := &target.Comment{
+		OldID:        srcComment.ID,
+		Comment:      m,
+		Revisions:    revisions,
+		IP:           net.ParseIP(srcComment.IPAddress),
+		OldInReplyTo: srcComment.InReplyTo,
+	}
+
+	// A batch cannot adopt a comment created by an interrupted run. The
+	// outcome of a batched comment is recorded once its batch is written.
+	if commentBatch != nil && !accounting.Interrupted(args.ItemTypeID, c.OldID) {
+		return commentBatch.add(c)
+	}
+
+	err = createComment(args, c)
 	if err != nil {
-		// Ignore errors relating to link embedding.
-		if !strings.Contains(err.Error(), "links_url_key") {
-			glog.Errorf("Failed to import comment for conversation %d: %s", srcComment.ID, err)
+		return err
+	}
+
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
+
+	if glog.V(2) {
+		glog.Infof("Successfully imported comment %d", srcComment.ID)
+	}
+
+	return nil
+}
+
+// createComment writes a single comment and records that it was imported. The
+// reply is recorded before the import so that a comment adopted from an
+// interrupted run is threaded.
+func createComment(args Args, c *target.Comment) error {
+	m := &c.Comment
+
+	orphanID, err := beginCreate(args, c.OldID, target.Orphan{
+		ItemTypeID:       args.ItemTypeID,
+		ParentItemTypeID: h.ItemTypes[m.ItemType],
+		ParentID:         m.ItemId,
+		CreatedByID:      m.Meta.CreatedById,
+		Created:          m.Meta.Created,
+	})
+	if err != nil {
+		return err
+	}
+
+	if orphanID > 0 {
+		m.Id = orphanID
+	} else {
+		err = args.Target.CreateComment(args.SiteID, m, c.IP)
+		if err != nil {
+			glog.Errorf("Failed to import comment for conversation %d: %s", c.OldID, err)
 			return err
 		}
 	}
 
-	tx, err := h.GetTransaction()
+	err = args.Target.CreateRevisions(args.SiteID, m.Id, c.Revisions)
 	if err != nil {
+		glog.Errorf("Failed to import versions of comment %d: %+v", c.OldID, err)
 		return err
 	}
-	defer tx.Rollback()
 
-	err = accounting.RecordImport(
-		tx,
+	if c.OldInReplyTo > 0 {
+		err = args.Target.RecordReply(args.OriginID, m.Id, c.OldInReplyTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return args.Target.RecordImport(
 		args.OriginID,
 		args.ItemTypeID,
-		srcComment.ID,
+		c.OldID,
 		m.Id,
 	)
-	if err != nil {
-		glog.Errorf("Failed to recordImport: %+v", err)
-		return err
+}
+
+// commentRevisions returns the versions of a comment or message as revisions,
+// oldest first. The first version is that written by the author when the item
+// was created, and each later version is by its editor when it was modified.
+// The text of each version is converted to Markdown.
+func commentRevisions(
+	args Args,
+	authorID int64,
+	created time.Time,
+	versions []src.Version,
+) ([]target.Revision, error) {
+
+	// Quotes link to the comments imported for the posts that they quote. The
+	// first error is kept, as Convert cannot return one.
+	var lookupErr error
+	lookup := func(oldPostID int64) int64 {
+		newID, err := accounting.GetNewID(
+			args.OriginID,
+			h.ItemTypes[h.ItemTypeComment],
+			oldPostID,
+		)
+		if err != nil && lookupErr == nil {
+			lookupErr = err
+		}
+		return newID
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		glog.Errorf("Failed to commit transaction: %+v", err)
-		return err
+	// Quotes of posts that are not imported yet link to the old forum, which the
+	// links phase rewrites once every comment has been imported
+	var oldHostname string
+	if len(config.OldHostnames) > 0 {
+		oldHostname = config.OldHostnames[0]
 	}
 
-	// Log the IP address
-	audit.Create(
-		args.SiteID,
-		h.ItemTypes[h.ItemTypeComment],
-		m.Id,
-		createdByID,
-		srcComment.DateCreated,
-		net.ParseIP(srcComment.IPAddress),
-	)
+	revisions := []target.Revision{}
+	for i, version := range versions {
+		r := target.Revision{
+			ProfileID:  authorID,
+			Markdown:   markup.Convert(version.Text, lookup, oldHostname),
+			Created:    created,
+			EditReason: version.EditReason,
+		}
+
+		if i > 0 {
+			// Exports do not always say when an edit was made, in which case
+			// it is treated as made at the same time as the version before it
+			r.Created = revisions[i-1].Created
+			if !version.DateModified.IsZero() {
+				r.Created = version.DateModified
+			}
+
+			if version.Editor > 0 {
+				var err error
+				r.ProfileID, err = accounting.GetNewID(
+					args.OriginID,
+					h.ItemTypes[h.ItemTypeProfile],
+					version.Editor,
+				)
+				if err != nil {
+					return nil, err
+				}
+				if r.ProfileID == 0 {
+					r.ProfileID = args.DeletedProfileID
+				}
+			}
+		}
 
-	commentsImportedThisRun = append(commentsImportedThisRun, srcComment.ID)
+		revisions = append(revisions, r)
+	}
 
-	if glog.V(2) {
-		glog.Infof("Successfully imported comment %d", srcComment.ID)
+	if lookupErr != nil {
+		return nil, lookupErr
 	}
 
-	return nil
+	return revisions, nil
 }
@@ -1,6 +1,7 @@
 package imp
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/golang/glog"
@@ -10,45 +11,44 @@ import (
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
 	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
 // importConversations walks the tree importing each conversation
-func importConversations(args conc.Args, gophers int) (errors []error) {
+func importConversations(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) (errors []error) {
 
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeConversation]
 
 	fmt.Println("Importing conversations...")
 	glog.Info("Importing conversations...")
 
-	err := files.WalkExportTree(args.RootPath, args.ItemTypeID)
-	if err != nil {
-		exitWithError(err, errors)
-	}
-
-	return conc.RunTasks(
-		files.GetIDs(args.ItemTypeID),
-		args,
-		importConversation,
-		gophers,
-	)
+	return streamTasks(ctx, args, importConversation, gophers)
 }
 
 // importConversation imports a single conversation or skips it if it has been
 // done aleady
-func importConversation(args conc.Args, itemID int64) error {
+func importConversation(args Args, itemID int64) error {
 
 	// Skip when it already exists
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		if glog.V(2) {
 			glog.Infof("Skipping conversation %d", itemID)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
 	srcConversation := src.Conversation{}
-	err := files.JSONFileToInterface(
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&srcConversation,
 	)
@@ -58,11 +58,14 @@ func importConversation(args conc.Args, itemID int64) error {
 	}
 
 	// Look up the author profile based on the old user ID.
-	createdByID := accounting.GetNewID(
+	createdByID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeProfile],
 		srcConversation.Author,
 	)
+	if err != nil {
+		return err
+	}
 	if createdByID == 0 {
 		createdByID = args.DeletedProfileID
 		if glog.V(2) {
@@ -73,18 +76,27 @@ func importConversation(args conc.Args, itemID int64) error {
 		}
 	}
 
-	microcosmID := accounting.GetNewID(
+	microcosmID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeMicrocosm],
 		srcConversation.ForumID,
 	)
+	if err != nil {
+		return err
+	}
 	if microcosmID == 0 {
-		return fmt.Errorf(
+		err := fmt.Errorf(
 			"Exported forum ID %d does not have an imported microcosm, "+
 				"skipped conversation %d\n",
 			srcConversation.ForumID,
 			itemID,
 		)
+		if args.DryRun {
+			glog.Error(err)
+			accounting.RecordOutcome(args.ItemTypeID, accounting.Orphaned)
+			return nil
+		}
+		return err
 	}
 
 	if len(srcConversation.Name) > 150 {
@@ -102,40 +114,42 @@ func importConversation(args conc.Args, itemID int64) error {
 	m.Meta.Flags.Open = srcConversation.Open
 	m.Meta.Flags.Sticky = srcConversation.Sticky
 
-	_, err = m.Import(args.SiteID, createdByID)
+	orphanID, err := beginCreate(args, srcConversation.ID, target.Orphan{
+		ItemTypeID:  args.ItemTypeID,
+		ParentID:    microcosmID,
+		Title:       m.Title,
+		CreatedByID: createdByID,
+		Created:     m.Meta.Created,
+	})
 	if err != nil {
-		glog.Errorf(
-			"Failed to createConversation for conversation %d: %+v",
-			itemID,
-			err,
-		)
 		return err
 	}
 
-	tx, err := h.GetTransaction()
-	if err != nil {
-		glog.Errorf("Failed to createMicrocosm for forum %d: %+v", itemID, err)
-		return err
+	if orphanID > 0 {
+		m.Id = orphanID
+	} else {
+		err = args.Target.CreateConversation(args.SiteID, createdByID, &m)
+		if err != nil {
+			glog.Errorf(
+				"Failed to createConversation for conversation %d: %+v",
+				itemID,
+				err,
+			)
+			return err
+		}
 	}
-	defer tx.Rollback()
 
-	err = accounting.RecordImport(
-		tx,
+	err = args.Target.RecordImport(
 		args.OriginID,
 		args.ItemTypeID,
 		srcConversation.ID,
 		m.Id,
 	)
 	if err != nil {
-		glog.Errorf("Failed to recordImport: %+v", err)
 		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		glog.Errorf("Failed to commit transaction: %+v", err)
-		return err
-	}
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
 
 	if glog.V(2) {
 		glog.Infof("Successfully imported conversation %d", itemID)
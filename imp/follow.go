@@ -1,6 +1,7 @@
 package imp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/golang/glog"
@@ -11,13 +12,16 @@ import (
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
 	"github.com/microcosm-cc/import-schemas/files"
 )
 
-func importFollows(args conc.Args, gophers int) (errors []error) {
+func importFollows(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) (errors []error) {
 
-	if !accounting.ImportFollows(args.OriginID) {
+	if !args.DryRun && !accounting.ImportFollows(args.OriginID) {
 		// It's been done before
 		return nil
 	}
@@ -32,15 +36,16 @@ func importFollows(args conc.Args, gophers int) (errors []error) {
 		exitWithError(err, errors)
 	}
 
-	errs := conc.RunTasks(
-		files.GetIDs(args.ItemTypeID),
+	errs := runTasks(
+		ctx,
+		getIDs(args),
 		args,
 		importFollow,
 		gophers,
 	)
 
 	// Record that we've done it
-	if len(errs) == 0 {
+	if len(errs) == 0 && !args.DryRun {
 		accounting.ImportedFollows(args.OriginID)
 	}
 
@@ -51,15 +56,20 @@ func importFollows(args conc.Args, gophers int) (errors []error) {
 // If there are any conversation follows, map to new ID.
 // Notify: true sets the email field to true. Ignore SMS.
 // Follow is one follow record, this implies multiple watchers.
-func importFollow(args conc.Args, itemID int64) error {
+func importFollow(args Args, itemID int64) error {
 
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		glog.Infof("Skipping watchers for profile %d", itemID)
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
 	srcFollow := src.Follow{}
-	err := files.JSONFileToInterface(
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&srcFollow,
 	)
@@ -69,32 +79,42 @@ func importFollow(args conc.Args, itemID int64) error {
 	}
 
 	// New owner profile ID
-	PID := accounting.GetNewID(
+	PID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeProfile],
 		srcFollow.Author,
 	)
+	if err != nil {
+		return err
+	}
 	if PID == 0 {
 		err = errors.New(fmt.Sprintf("No new ID for profile %d, skipped follows", srcFollow.Author))
 		glog.Error(err.Error())
+		if args.DryRun {
+			accounting.RecordOutcome(args.ItemTypeID, accounting.Orphaned)
+			return nil
+		}
 		return err
 	}
 
 	// Users following
 	for _, user := range srcFollow.Users {
 		// Fetch the new profile ID of user being followed.
-		followPID := accounting.GetNewID(
+		followPID, err := accounting.GetNewID(
 			args.OriginID,
 			h.ItemTypes[h.ItemTypeProfile],
 			user.ID,
 		)
+		if err != nil {
+			return err
+		}
 		w := models.WatcherType{
 			ProfileID:  PID,
 			ItemID:     followPID,
 			ItemTypeID: h.ItemTypes[h.ItemTypeProfile],
 			SendEmail:  user.Notify,
 		}
-		_, err := w.Import()
+		err = args.Target.CreateWatcher(&w)
 		if err != nil {
 			// Ignore complaints about non-uniques
 			if !strings.Contains(err.Error(), "unique") {
@@ -105,18 +125,21 @@ func importFollow(args conc.Args, itemID int64) error {
 
 	// Forums following
 	for _, forum := range srcFollow.Forums {
-		FID := accounting.GetNewID(
+		FID, err := accounting.GetNewID(
 			args.OriginID,
 			h.ItemTypes[h.ItemTypeMicrocosm],
 			forum.ID,
 		)
+		if err != nil {
+			return err
+		}
 		w := models.WatcherType{
 			ProfileID:  PID,
 			ItemID:     FID,
 			ItemTypeID: h.ItemTypes[h.ItemTypeMicrocosm],
 			SendEmail:  forum.Notify,
 		}
-		_, err := w.Import()
+		err = args.Target.CreateWatcher(&w)
 		if err != nil {
 			// Ignore complaints about non-uniques
 			if !strings.Contains(err.Error(), "unique") {
@@ -127,18 +150,21 @@ func importFollow(args conc.Args, itemID int64) error {
 
 	// Conversations following
 	for _, conv := range srcFollow.Conversations {
-		CID := accounting.GetNewID(
+		CID, err := accounting.GetNewID(
 			args.OriginID,
 			h.ItemTypes[h.ItemTypeConversation],
 			conv.ID,
 		)
+		if err != nil {
+			return err
+		}
 		w := models.WatcherType{
 			ProfileID:  PID,
 			ItemID:     CID,
 			ItemTypeID: h.ItemTypes[h.ItemTypeConversation],
 			SendEmail:  conv.Notify,
 		}
-		_, err := w.Import()
+		err = args.Target.CreateWatcher(&w)
 		if err != nil {
 			// Ignore complaints about non-uniques
 			if !strings.Contains(err.Error(), "unique") {
@@ -148,20 +174,14 @@ func importFollow(args conc.Args, itemID int64) error {
 	}
 
 	// One follow ID will map to multiple watcher IDs.
-	// Store a '1' for the new follow ID value, to signify
+	// Store the new profile ID for the new follow ID value, to signify
 	// that all follows for the current profile have been processed.
-	tx, err := h.GetTransaction()
+	err = args.Target.RecordImport(args.OriginID, args.ItemTypeID, itemID, PID)
 	if err != nil {
-		glog.Error(err.Error())
 		return err
 	}
-	err = accounting.RecordImport(tx, args.OriginID, args.ItemTypeID, itemID, 1)
-	if err != nil {
-		glog.Error(err.Error())
-	}
-	err = tx.Commit()
-	if err != nil {
-		glog.Error(err.Error())
-	}
-	return err
+
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
+
+	return nil
 }
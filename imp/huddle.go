@@ -1,42 +1,39 @@
 package imp
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"strings"
 
 	"github.com/golang/glog"
 
 	src "github.com/microcosm-cc/export-schemas/go/forum"
-	"github.com/microcosm-cc/microcosm/audit"
 	h "github.com/microcosm-cc/microcosm/helpers"
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
 	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
-func importHuddles(args conc.Args, gophers int) []error {
+func importHuddles(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) []error {
 
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeHuddle]
 
 	fmt.Println("Importing messages")
 	glog.Info("Importing messages")
 
-	err := files.WalkExportTree(args.RootPath, args.ItemTypeID)
-	if err != nil {
-		exitWithError(err, []error{})
-	}
+	errs := streamTasks(ctx, args, importHuddle, gophers)
 
-	errs := conc.RunTasks(
-		files.GetIDs(args.ItemTypeID),
-		args,
-		importHuddle,
-		gophers,
-	)
+	if args.DryRun {
+		return errs
+	}
 
-	err = models.MarkAllHuddlesForAllProfilesAsReadOnSite(args.SiteID)
+	err := models.MarkAllHuddlesForAllProfilesAsReadOnSite(args.SiteID)
 	if err != nil {
 		errs = append(errs, err)
 	}
@@ -44,18 +41,23 @@ func importHuddles(args conc.Args, gophers int) []error {
 	return errs
 }
 
-func importHuddle(args conc.Args, itemID int64) error {
+func importHuddle(args Args, itemID int64) error {
 
 	// Skip message if already imported.
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		if glog.V(2) {
 			glog.Infof("Skipping comment %d\n", itemID)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
 	srcMessage := src.Message{}
-	err := files.JSONFileToInterface(
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&srcMessage,
 	)
@@ -65,11 +67,14 @@ func importHuddle(args conc.Args, itemID int64) error {
 	}
 
 	// Look up the author profile based on the old user ID.
-	authorID := accounting.GetNewID(
+	authorID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeProfile],
 		srcMessage.Author,
 	)
+	if err != nil {
+		return err
+	}
 	if authorID == 0 {
 		authorID = args.DeletedProfileID
 		if glog.V(2) {
@@ -80,8 +85,29 @@ func importHuddle(args conc.Args, itemID int64) error {
 		}
 	}
 
+	if len(srcMessage.Versions) == 0 {
+		return fmt.Errorf("Message %d has no versions", srcMessage.ID)
+	}
+	revisions, err := commentRevisions(
+		args,
+		authorID,
+		srcMessage.DateCreated,
+		srcMessage.Versions,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Edits do not always repeat the subject, so use the latest one given
+	var title string
+	for _, version := range srcMessage.Versions {
+		if version.Headline != "" {
+			title = version.Headline
+		}
+	}
+
 	huddle := models.HuddleType{
-		Title:          srcMessage.Versions[0].Headline,
+		Title:          title,
 		IsConfidential: true,
 	}
 	huddle.Meta.Flags.Deleted = srcMessage.Deleted
@@ -95,11 +121,14 @@ func importHuddle(args conc.Args, itemID int64) error {
 	participants[authorID] = true
 
 	for _, to := range srcMessage.To {
-		RID := accounting.GetNewID(
+		RID, err := accounting.GetNewID(
 			args.OriginID,
 			h.ItemTypes[h.ItemTypeProfile],
 			to.ID,
 		)
+		if err != nil {
+			return err
+		}
 		if RID > 0 {
 			r := models.ProfileSummaryType{
 				Id: RID,
@@ -112,11 +141,14 @@ func importHuddle(args conc.Args, itemID int64) error {
 		}
 	}
 	for _, to := range srcMessage.BCC {
-		RID := accounting.GetNewID(
+		RID, err := accounting.GetNewID(
 			args.OriginID,
 			h.ItemTypes[h.ItemTypeProfile],
 			to.ID,
 		)
+		if err != nil {
+			return err
+		}
 		if RID > 0 {
 			r := models.ProfileSummaryType{
 				Id: RID,
@@ -129,65 +161,91 @@ func importHuddle(args conc.Args, itemID int64) error {
 		}
 	}
 
-	_, err = huddle.Import(args.SiteID)
-	if err != nil {
-		glog.Errorf("Failed to create huddle %d: %+v", itemID, err)
-		return err
-	}
-
 	m := models.CommentSummaryType{
 		ItemType: "huddle",
-		ItemId:   huddle.Id,
-		Markdown: srcMessage.Versions[0].Text,
+		Markdown: revisions[len(revisions)-1].Markdown,
 	}
 	m.Meta.Created = srcMessage.DateCreated
 	m.Meta.CreatedById = authorID
 	m.Meta.Flags.Deleted = srcMessage.Deleted
 	m.Meta.Flags.Visible = !srcMessage.Deleted
 
-	_, err = m.Import(args.SiteID)
+	orphanID, err := beginCreate(args, srcMessage.ID, target.Orphan{
+		ItemTypeID:  args.ItemTypeID,
+		SiteID:      args.SiteID,
+		Title:       huddle.Title,
+		CreatedByID: authorID,
+		Created:     huddle.Meta.Created,
+	})
+	if err != nil {
+		return err
+	}
 
+	if orphanID > 0 {
+		err = adoptHuddle(args, orphanID, &huddle, &m, srcMessage.IPAddress)
+	} else {
+		err = args.Target.CreateHuddle(
+			args.SiteID,
+			&huddle,
+			&m,
+			net.ParseIP(srcMessage.IPAddress),
+		)
+	}
 	if err != nil {
-		// Ignore errors relating to link embedding.
-		if !strings.Contains(err.Error(), "links_url_key") {
-			glog.Errorf("Failed to import comment for huddle %d: %s", srcMessage.ID, err)
-			return err
-		}
+		glog.Errorf("Failed to create huddle %d: %+v", itemID, err)
+		return err
 	}
 
-	tx, err := h.GetTransaction()
+	err = args.Target.CreateRevisions(args.SiteID, m.Id, revisions)
 	if err != nil {
+		glog.Errorf("Failed to import versions of message %d: %+v", itemID, err)
 		return err
 	}
-	defer tx.Rollback()
 
-	err = accounting.RecordImport(
-		tx,
+	err = args.Target.RecordImport(
 		args.OriginID,
 		args.ItemTypeID,
 		srcMessage.ID,
 		huddle.Id,
 	)
 	if err != nil {
-		glog.Errorf("Failed to recordImport: %+v", err)
 		return err
 	}
 
-	err = tx.Commit()
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
+
+	return nil
+}
+
+// adoptHuddle adopts a huddle created by an interrupted run, along with its
+// message. The huddle and its message are created separately, so the message
+// is created if the run was interrupted before it was.
+func adoptHuddle(
+	args Args,
+	huddleID int64,
+	huddle *models.HuddleType,
+	m *models.CommentSummaryType,
+	ipAddress string,
+) error {
+
+	huddle.Id = huddleID
+	m.ItemId = huddleID
+
+	commentID, err := args.Target.FindOrphan(target.Orphan{
+		ItemTypeID:       h.ItemTypes[h.ItemTypeComment],
+		ParentItemTypeID: args.ItemTypeID,
+		ParentID:         huddleID,
+		CreatedByID:      m.Meta.CreatedById,
+		Created:          m.Meta.Created,
+	})
 	if err != nil {
-		glog.Errorf("Failed to commit transaction: %+v", err)
 		return err
 	}
 
-	// Log the IP address
-	audit.Create(
-		args.SiteID,
-		h.ItemTypes[h.ItemTypeHuddle],
-		huddle.Id,
-		authorID,
-		srcMessage.DateCreated,
-		net.ParseIP(srcMessage.IPAddress),
-	)
+	if commentID > 0 {
+		m.Id = commentID
+		return nil
+	}
 
-	return nil
+	return args.Target.CreateComment(args.SiteID, m, net.ParseIP(ipAddress))
 }
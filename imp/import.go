@@ -1,25 +1,84 @@
 package imp
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/golang/glog"
 
+	h "github.com/microcosm-cc/microcosm/helpers"
 	"github.com/microcosm-cc/microcosm/models"
 
+	"github.com/microcosm-cc/import-schemas/accounting"
 	"github.com/microcosm-cc/import-schemas/conc"
 	"github.com/microcosm-cc/import-schemas/config"
+	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/registry"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
-// We should only use 50 gophers as we expect each one to trigger database
-// connections and eventually we need this to run on a live site without
-// breaking it
-const gophers int = 2
+// The number of gophers used for an item type that has not been configured
+const defaultGophers int64 = 2
+
+// Args are the arguments passed to every import task. Alongside the conc.Args
+// that control how the tasks are run they hold where the imported items are
+// written.
+type Args struct {
+	conc.Args
+
+	// Target is where imported items are written. During a dry run it is in
+	// memory and tasks must not write to the database.
+	Target target.Target
+}
+
+// Options control how an import is run
+type Options struct {
+	// Finalise imports the follows and roles, which are not repeatable
+	Finalise bool
+
+	// DryRun writes nothing to the database. Every item in the export is
+	// still read and its references resolved, and a report of what would have
+	// been created, skipped or orphaned is printed at the end.
+	DryRun bool
+
+	// ContinueOnError keeps importing the remaining items when an item fails.
+	// The items that failed are recorded in the failure ledger.
+	ContinueOnError bool
+
+	// RetryFailures is the name of an item type, i.e. "comment". When set only
+	// the items of that type in the failure ledger are imported.
+	RetryFailures string
+
+	// Only is a comma separated list of the phases to run, i.e.
+	// "comments,attachments". Naming a finalise phase runs it without
+	// Finalise.
+	Only string
+
+	// Skip is a comma separated list of the phases not to run
+	Skip string
+
+	// AllowUnsupported imports an export from a product or version that is not
+	// supported, rather than refusing to
+	AllowUnsupported bool
+}
 
 // Import orchestrates and runs the import job, ensuring that any dependencies
 // are imported before they are needed. This is mostly a top level ordering of
 // things: profiles before the comments they made, etc.
-func Import(finalise bool) {
+//
+// Cancelling ctx stops the import once the items in progress have finished.
+func Import(ctx context.Context, opts Options) {
+	// Which forum software the export came from
+	manifest, err := files.LoadManifest(config.Rootpath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	err = checkSource(manifest, opts.AllowUnsupported)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	fmt.Printf("Importing from %s\n", manifest)
+
 	// Load all profiles and create a single user entry corresponding to the site
 	// admin.
 	srcAdminProfile, err := loadProfiles(config.Rootpath, config.SiteOwnerID)
@@ -28,16 +87,64 @@ func Import(finalise bool) {
 	}
 
 	// Create the site and the admin user to initialise the import
-	originID, siteID, adminProfileID := createSiteAndAdminUser(srcAdminProfile)
+	var (
+		originID, siteID, adminProfileID int64
+		tgt                              target.Target
+	)
+	if opts.DryRun {
+		fmt.Println("Dry run, nothing will be written to the database")
+		tgt = target.NewMemory()
+
+		adminProfile, _, err := tgt.CreateProfile(siteID, srcAdminProfile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		adminProfileID = adminProfile.Id
+
+		err = tgt.RecordImport(
+			originID,
+			h.ItemTypes[h.ItemTypeProfile],
+			srcAdminProfile.ID,
+			adminProfileID,
+		)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	} else {
+		// A dry run has no database to look up IDs that are not on disk, and
+		// imports nothing worth keeping
+		if config.IDStore == config.IDStoreDisk {
+			accounting.UseDiskStore(config.Rootpath)
+			defer accounting.CloseStore()
+		}
+
+		tgt = target.Microcosm{}
+		originID, siteID, adminProfileID = createSiteAndAdminUser(
+			srcAdminProfile,
+			manifest,
+		)
+	}
 
 	// Create args for all concurrent jobs, these are basically shared values
 	// to help normalise the signature of tasks so that we can run lots of
 	// different tasks as if the functions had the same signature.
-	args := conc.Args{
-		RootPath:           config.Rootpath,
-		OriginID:           originID,
-		SiteID:             siteID,
-		SiteOwnerProfileID: adminProfileID,
+	args := Args{
+		Args: conc.Args{
+			RootPath:           config.Rootpath,
+			Exported:           manifest.Exported,
+			OriginID:           originID,
+			SiteID:             siteID,
+			SiteOwnerProfileID: adminProfileID,
+			DryRun:             opts.DryRun,
+			ContinueOnError:    opts.ContinueOnError,
+		},
+		Target: tgt,
+	}
+
+	// A dry run does not touch the database, so there is nothing to protect
+	if !opts.DryRun {
+		args.TargetLatency = config.TargetLatency
+		args.MaxItemsPerSecond = config.MaxItemsPerSecond
 	}
 
 	// Create a user for orphaned content
@@ -51,84 +158,256 @@ func Import(finalise bool) {
 		glog.Infof("Args for import: %+v", args)
 	}
 
-	// Import all other users.
-	// NOTE: Can only use 1 gopher as users may have multiple profiles and we
-	// wish to only keep the oldest (lowest numbered) profile.
-	errs := importProfiles(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
-		}
-		glog.Flush()
-
-		// If we have errors we do not continue. Errors importing profiles
-		// cascade significantly as everything is associated to a profile.
+	if opts.RetryFailures != "" {
+		retryFailures(ctx, args, opts.RetryFailures)
 		return
 	}
 
-	// Import microcosms.
-	errs = importMicrocosms(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
+	selected, err := selectPhases(
+		opts.Only,
+		opts.Skip,
+		// A dry run writes nothing, so it can always validate the follows and
+		// roles
+		opts.Finalise || opts.DryRun,
+	)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	err = checkRequirements(args.RootPath, args.OriginID, selected)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	for _, p := range phases {
+		if !selected[p.Name] {
+			continue
 		}
-		glog.Flush()
 
-		// If we have errors we do not continue. Errors importing forums
-		// cascade significantly as conversations are associated to the forums.
-		return
+		errs := p.Run(ctx, args, gophersFor(p.ItemType))
+		stop := stopOnErrors(args, h.ItemTypes[p.ItemType], errs)
+		if p.StopOnCancelOnly {
+			stop = stop && ctx.Err() != nil
+		}
+		if stop {
+			// If we have errors we do not continue. Errors cascade
+			// significantly as everything is associated to a profile, comments
+			// to conversations, and so on.
+			return
+		}
 	}
 
-	// Import conversations.
-	errs = importConversations(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
+	// Roles must be the very last thing we do, once they are imported the site
+	// is secured and complete.
+	if selected["roles"] && !args.DryRun {
+		models.MarkAllMicrocosmsForAllProfilesAsReadOnSite(args.SiteID)
+	}
+
+	if opts.DryRun {
+		accounting.PrintReport()
+	}
+}
+
+// runTasks wraps conc.RunTasks. During a dry run an error returned by a task
+// is logged and tallied as a failure rather than cancelling the remaining
+// tasks, so that a single run finds every problem in the export.
+func runTasks(
+	ctx context.Context,
+	ids []int64,
+	args Args,
+	task func(Args, int64) error,
+	gophers int,
+) []error {
+
+	return conc.RunTasks(
+		ctx,
+		ids,
+		args.Args,
+		concTask(args, dryRunTask(args, task)),
+		gophers,
+	)
+}
+
+// streamTasks runs the task for every item of args.ItemTypeID in the export,
+// streaming the IDs from the export rather than holding them all in memory.
+// The IDs are in the order of the index.json or of the paths of the directory
+// walk, which is not ascending order. When failures are being retried only the
+// IDs in the failure ledger are used.
+func streamTasks(
+	ctx context.Context,
+	args Args,
+	task func(Args, int64) error,
+	gophers int,
+) []error {
+
+	if args.RetryFailures {
+		// The paths of the items are not known, as the export was not walked
+		files.DeriveRoot(args.RootPath, args.ItemTypeID)
+
+		return runTasks(ctx, getIDs(args), args, task, gophers)
+	}
+
+	return conc.RunTaskStream(
+		ctx,
+		func(ctx context.Context, ids chan<- int64) error {
+			return files.StreamIDs(ctx, args.RootPath, args.ItemTypeID, ids)
+		},
+		0,
+		args.Args,
+		concTask(args, dryRunTask(args, task)),
+		gophers,
+	)
+}
+
+// concTask adapts a task to the signature that conc runs, passing it args
+// rather than the conc.Args that conc holds
+func concTask(
+	args Args,
+	task func(Args, int64) error,
+) func(conc.Args, int64) error {
+
+	return func(_ conc.Args, itemID int64) error {
+		return task(args, itemID)
+	}
+}
+
+// dryRunTask returns the task unchanged, except during a dry run when an error
+// is logged and tallied as a failure rather than returned
+func dryRunTask(
+	args Args,
+	task func(Args, int64) error,
+) func(Args, int64) error {
+
+	if !args.DryRun {
+		return task
+	}
+
+	return func(args Args, itemID int64) error {
+		err := task(args, itemID)
+		if err != nil {
+			glog.Errorf("Failed on ID %d : %+v", itemID, err)
+			accounting.RecordOutcome(args.ItemTypeID, accounting.Failed)
 		}
-		glog.Flush()
+		return nil
+	}
+}
 
-		// If we have errors we do not continue. Errors importing conversations
-		// cascade significantly as comments are associated to the conversations.
-		return
+// stopOnErrors logs the errors from importing an item type and records the
+// items that failed in the failure ledger. It returns true if there were errors
+// and the import should not continue to the next item type.
+func stopOnErrors(args Args, itemTypeID int64, errs []error) bool {
+	var cancelled bool
+
+	failures := []accounting.Failure{}
+	for _, err := range errs {
+		glog.Error(err)
+
+		if err == context.Canceled {
+			cancelled = true
+		}
+
+		if taskErr, ok := err.(conc.TaskError); ok {
+			failures = append(failures, accounting.Failure{
+				OldID: taskErr.ID,
+				Error: taskErr.Err.Error(),
+			})
+		}
 	}
+	glog.Flush()
 
-	// Import comments.
-	errs = importComments(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
+	// Phases without an item type have no failure ledger
+	if !args.DryRun && itemTypeID != 0 {
+		err := accounting.RecordFailures(
+			args.RootPath,
+			args.OriginID,
+			itemTypeID,
+			failures,
+		)
+		if err != nil {
+			glog.Errorf("Failed to record failures: %+v", err)
 		}
-		glog.Flush()
+	}
 
-		// If we have errors we do not continue. Errors importing comments
-		// cascade significantly as attachments are associated to the comments.
-		return
+	if len(failures) > 0 && itemTypeID == 0 {
+		fmt.Printf("%d items failed. Please check logs\n", len(failures))
+	} else if len(failures) > 0 {
+		fmt.Printf(
+			"%d %s items failed to import. Please check logs\n",
+			len(failures),
+			registry.Name(itemTypeID),
+		)
 	}
 
-	// Import messages as huddles.
-	errs = importHuddles(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
+	if cancelled {
+		fmt.Println("Import cancelled")
+	}
+
+	return cancelled || (len(errs) > 0 && !args.ContinueOnError)
+}
+
+// retryFailures imports only the items of the named item type that are in the
+// failure ledger
+func retryFailures(ctx context.Context, args Args, itemType string) {
+	args.RetryFailures = true
+
+	// Roles are not imported item by item, and so have no failure ledger
+	for _, p := range phases {
+		if p.ItemType != itemType || p.ItemType == h.ItemTypeRole {
+			continue
 		}
-		glog.Flush()
 
+		errs := p.Run(ctx, args, gophersFor(p.ItemType))
+		stopOnErrors(args, h.ItemTypes[itemType], errs)
 		return
 	}
 
-	// Can be highly concurrent as nearly all activity here is going to be disk
-	// and network limited... perhaps 100+ gophers?
-	errs = importAttachments(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
+	glog.Fatalf("Cannot retry failures for item type: %s", itemType)
+}
+
+// gophersFor returns the number of items of the given type to import
+// concurrently, which leaves config.ReservedConnections of the connections free
+// for whatever else needs one whilst every gopher holds one
+func gophersFor(itemType string) int {
+	n, ok := config.Gophers[itemType]
+	if !ok {
+		n = defaultGophers
+	}
+
+	maxGophers := config.MaxConnections - config.ReservedConnections
+	if config.MaxConnections > 0 && n > maxGophers {
+		n = maxGophers
+	}
+
+	return int(n)
+}
+
+// getIDs returns the IDs of the items of args.ItemTypeID to import. These are
+// all of the IDs discovered by the walk of the exported files, unless failures
+// are being retried in which case they are the IDs in the failure ledger.
+func getIDs(args Args) []int64 {
+	if !args.RetryFailures {
+		ids, err := files.GetIDs(args.ItemTypeID)
+		if err != nil {
+			glog.Fatal(err)
 		}
-		glog.Flush()
+		return ids
+	}
+
+	failures, err := accounting.LoadFailures(
+		args.RootPath,
+		args.OriginID,
+		args.ItemTypeID,
+	)
+	if err != nil {
+		glog.Fatal(err)
 	}
 
-	if finalise {
-		doFinalise(args)
+	ids := []int64{}
+	for _, failure := range failures {
+		ids = append(ids, failure.OldID)
 	}
+
+	return ids
 }
 
 func exitWithError(fatal error, errors []error) {
@@ -142,39 +421,3 @@ func exitWithError(fatal error, errors []error) {
 
 	glog.Fatal(fatal)
 }
-
-func doFinalise(args conc.Args) {
-	// These steps are not repeatable and should only be run after everything
-	// else has completed successfully
-
-	// Import follows.
-	errs := importFollows(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
-		}
-		glog.Flush()
-	}
-
-	// Import roles
-	//
-	// Roles must be the very last thing we do, as once we add permissions we
-	// will be securing the site and a lot of the prior imports would fail if
-	// the permissions today didn't precisely match the permissions at the time
-	// that content was created... which is extremely unlikely.
-	//
-	// As a result, we shouldn't import roles until we are sure we got here
-	// without error, as roles will reduce the overall resumability of an import
-	errs = importRoles(args, gophers)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			glog.Error(err)
-		}
-		glog.Flush()
-
-		// If we have errors we do not continue. Errors importing roles is fatal
-		return
-	}
-
-	models.MarkAllMicrocosmsForAllProfilesAsReadOnSite(args.SiteID)
-}
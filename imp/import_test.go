@@ -0,0 +1,178 @@
+package imp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/conc"
+	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/target"
+)
+
+// writeItem writes an item of the fixture export to where export-schemas would
+func writeItem(t *testing.T, rootPath string, itemType string, id int64, v interface{}) {
+	name, err := files.DerivePath(rootPath, h.ItemTypes[itemType], id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(path.Dir(name), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestImportDryRun imports a small export into the memory target, and checks
+// what was recorded as imported for each item type
+func TestImportDryRun(t *testing.T) {
+	const originID int64 = 1201
+
+	rootPath, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	created := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Profiles 2 and 3 share an email address, and so are merged
+	for _, sp := range []src.Profile{
+		{ID: 1, Email: "owner@example.com", Name: "owner"},
+		{ID: 2, Email: "alice@example.com", Name: "alice"},
+		{ID: 3, Email: "ALICE@example.com", Name: "alice2"},
+	} {
+		sp.DateCreated = created
+		writeItem(t, rootPath, h.ItemTypeProfile, sp.ID, sp)
+	}
+
+	f := forum{DateCreated: created}
+	f.ID = 10
+	f.Name = "General"
+	f.Author = 2
+	writeItem(t, rootPath, h.ItemTypeMicrocosm, f.ID, f)
+
+	// Conversation 21 is in a forum that is not in the export, and so is an
+	// orphan as is its comment
+	for _, sc := range []src.Conversation{
+		{ID: 20, ForumID: 10, Author: 2, Name: "Hello"},
+		{ID: 21, ForumID: 99, Author: 2, Name: "Lost"},
+	} {
+		sc.DateCreated = created
+		writeItem(t, rootPath, h.ItemTypeConversation, sc.ID, sc)
+	}
+
+	for _, c := range []struct {
+		id, onID, author, inReplyTo int64
+		text                        string
+	}{
+		{30, 20, 2, 0, "First *post*"},
+		{31, 20, 3, 30, "[quote=alice;30]First[/quote]Reply"},
+		{32, 21, 2, 0, "Orphaned"},
+	} {
+		sc := src.Comment{}
+		sc.ID = c.id
+		sc.Author = c.author
+		sc.InReplyTo = c.inReplyTo
+		sc.DateCreated = created
+		sc.Association.OnID = c.onID
+		sc.Versions = []src.Version{{Text: c.text}}
+		writeItem(t, rootPath, h.ItemTypeComment, sc.ID, sc)
+	}
+
+	args := Args{
+		Args: conc.Args{
+			RootPath: rootPath,
+			OriginID: originID,
+			DryRun:   true,
+		},
+		Target: target.NewMemory(),
+	}
+
+	owner, err := loadProfiles(rootPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerProfile, _, err := args.Target.CreateProfile(args.SiteID, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args.SiteOwnerProfileID = ownerProfile.Id
+
+	ctx := context.Background()
+	for _, run := range []func(context.Context, Args, int) []error{
+		importProfiles,
+		importMicrocosms,
+		importConversations,
+		importComments,
+	} {
+		if errs := run(ctx, args, 2); len(errs) > 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+	}
+
+	newID := func(itemType string, oldID int64) int64 {
+		id, err := accounting.GetNewID(originID, h.ItemTypes[itemType], oldID)
+		if err != nil {
+			t.Fatalf("GetNewID(%s %d) failed: %+v", itemType, oldID, err)
+		}
+		return id
+	}
+
+	for _, test := range []struct {
+		itemType string
+		imported []int64
+		missing  []int64
+	}{
+		{h.ItemTypeProfile, []int64{1, 2, 3}, nil},
+		{h.ItemTypeMicrocosm, []int64{10}, []int64{99}},
+		{h.ItemTypeConversation, []int64{20}, []int64{21}},
+		{h.ItemTypeComment, []int64{30, 31}, []int64{32}},
+	} {
+		for _, oldID := range test.imported {
+			if newID(test.itemType, oldID) == 0 {
+				t.Errorf("Expected %s %d to be imported", test.itemType, oldID)
+			}
+		}
+		for _, oldID := range test.missing {
+			if id := newID(test.itemType, oldID); id != 0 {
+				t.Errorf("Expected %s %d not to be imported, got %d", test.itemType, oldID, id)
+			}
+		}
+
+		n, err := accounting.CountImports(originID, h.ItemTypes[test.itemType])
+		if err != nil || n != len(test.imported) {
+			t.Errorf(
+				"CountImports(%s) = %d, %v, want %d",
+				test.itemType,
+				n,
+				err,
+				len(test.imported),
+			)
+		}
+	}
+
+	if alice, alice2 := newID(h.ItemTypeProfile, 2), newID(h.ItemTypeProfile, 3); alice != alice2 {
+		t.Errorf("Expected profiles sharing an email address to merge, got %d and %d", alice, alice2)
+	}
+	if newID(h.ItemTypeProfile, 1) != args.SiteOwnerProfileID {
+		t.Errorf("Expected the owner to be imported as the site owner")
+	}
+}
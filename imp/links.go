@@ -0,0 +1,391 @@
+package imp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+	"github.com/microcosm-cc/microcosm/models"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/config"
+)
+
+// unresolvedLink is a link to the old forum that could not be rewritten
+type unresolvedLink struct {
+	CommentID int64  `json:"commentId"`
+	URL       string `json:"url"`
+	Reason    string `json:"reason"`
+}
+
+var (
+	// oldLink matches links to the old forum, set by rewriteLinks
+	oldLink *regexp.Regexp
+
+	unresolvedLinks     []unresolvedLink
+	unresolvedLinksLock sync.Mutex
+)
+
+// vBulletin 4 can be configured to use friendly URLs, i.e. /threads/123-title
+var friendlyPath = regexp.MustCompile(`/(threads|members|forums)/(\d+)`)
+
+// rewriteLinks rewrites the links within imported comments and messages that
+// point at the old forum, so that they point at the items that were imported
+// instead. Links that cannot be rewritten are left as they are and written to
+// a report in the export root.
+//
+// The links are found in the database rather than the export, and the pass is
+// repeatable as a link that has been rewritten no longer points at the old
+// forum.
+func rewriteLinks(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) []error {
+
+	if len(config.OldHostnames) == 0 {
+		fmt.Println("No old_hostnames are configured, links will not be rewritten")
+		glog.Info("No old_hostnames are configured, links will not be rewritten")
+		return nil
+	}
+
+	// Nothing was written, so there are no links to rewrite
+	if args.DryRun {
+		return nil
+	}
+
+	fmt.Println("Rewriting links to the old forum...")
+	glog.Info("Rewriting links to the old forum...")
+
+	hosts := []string{}
+	for _, hostname := range config.OldHostnames {
+		hosts = append(hosts, regexp.QuoteMeta(hostname))
+	}
+	// The character before the link is matched so that a hostname within
+	// another, i.e. lfgss.com within notlfgss.com, is not
+	oldLink = regexp.MustCompile(
+		`(?i)(^|[^\w.-])((?:https?:)?(?://)?(?:` + strings.Join(hosts, "|") +
+			`)(?:/[^\s)\]"'<>]*|\b))`,
+	)
+
+	revisionIDs, err := getRevisionsWithOldLinks(args.OriginID)
+	if err != nil {
+		return []error{err}
+	}
+
+	unresolvedLinks = []unresolvedLink{}
+
+	errs := runTasks(ctx, revisionIDs, args, rewriteRevisionLinks, gophers)
+
+	err = reportUnresolvedLinks(args)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// getRevisionsWithOldLinks returns the IDs of the current revisions of the
+// comments and messages imported by the origin that mention an old hostname
+func getRevisionsWithOldLinks(originID int64) ([]int64, error) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	params := []interface{}{
+		originID,
+		h.ItemTypes[h.ItemTypeComment],
+		h.ItemTypes[h.ItemTypeHuddle],
+	}
+	mentions := []string{}
+	for _, hostname := range config.OldHostnames {
+		params = append(params, "%"+hostname+"%")
+		mentions = append(mentions, fmt.Sprintf("r.raw ILIKE $%d", len(params)))
+	}
+
+	rows, err := db.Query(`
+SELECT r.revision_id
+  FROM revisions r
+  JOIN comments c ON c.comment_id = r.comment_id
+ WHERE r.is_current IS TRUE
+   AND (
+           c.comment_id IN (
+               SELECT item_id
+                 FROM imported_items
+                WHERE origin_id = $1
+                  AND item_type_id = $2
+           )
+        OR (
+               c.item_type_id = $3
+           AND c.item_id IN (
+                   SELECT item_id
+                     FROM imported_items
+                    WHERE origin_id = $1
+                      AND item_type_id = $3
+               )
+           )
+       )
+   AND (`+strings.Join(mentions, " OR ")+`)
+ ORDER BY r.revision_id`,
+		params...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return ids, nil
+}
+
+// rewriteRevisionLinks rewrites the links to the old forum within the raw text
+// of a revision, and renders its HTML again from the rewritten text
+func rewriteRevisionLinks(args Args, revisionID int64) error {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		commentID  int64
+		itemTypeID int64
+		itemID     int64
+		raw        string
+	)
+	err = tx.QueryRow(`
+SELECT r.comment_id
+      ,c.item_type_id
+      ,c.item_id
+      ,r.raw
+  FROM revisions r
+  JOIN comments c ON c.comment_id = r.comment_id
+ WHERE r.revision_id = $1
+   FOR UPDATE OF r`,
+		revisionID,
+	).Scan(
+		&commentID,
+		&itemTypeID,
+		&itemID,
+		&raw,
+	)
+	if err != nil {
+		return err
+	}
+
+	newRaw := replaceOldLinks(args, commentID, raw)
+	if newRaw == raw {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+UPDATE revisions
+   SET raw = $2
+ WHERE revision_id = $1`,
+		revisionID,
+		newRaw,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = models.ProcessCommentMarkdown(
+		tx,
+		revisionID,
+		newRaw,
+		args.SiteID,
+		itemTypeID,
+		itemID,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceOldLinks replaces every link to the old forum in the text that can be
+// resolved, and reports those that cannot
+func replaceOldLinks(args Args, commentID int64, text string) string {
+
+	return oldLink.ReplaceAllStringFunc(text, func(match string) string {
+		m := oldLink.FindStringSubmatch(match)
+		before, link := m[1], m[2]
+
+		// Punctuation that ends a sentence is not part of the link
+		trimmed := strings.TrimRight(link, ".,;:!?")
+		after := link[len(trimmed):]
+		link = trimmed
+
+		newURL, reason := resolveOldLink(args, link)
+		if newURL != "" {
+			return before + newURL + after
+		}
+
+		unresolvedLinksLock.Lock()
+		unresolvedLinks = append(unresolvedLinks, unresolvedLink{
+			CommentID: commentID,
+			URL:       link,
+			Reason:    reason,
+		})
+		unresolvedLinksLock.Unlock()
+
+		return before + link + after
+	})
+}
+
+// resolveOldLink returns the URL of the imported item that a link to the old
+// forum points at, or the reason why it could not be resolved
+func resolveOldLink(args Args, link string) (string, string) {
+	original := link
+
+	// Links converted from HTML may escape the ampersands of a query
+	link = strings.Replace(link, "&amp;", "&", -1)
+	if !strings.Contains(link, "//") {
+		link = "//" + link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "not a valid URL"
+	}
+	query := u.Query()
+
+	// Links to the home page become links to the site, but a hostname that is
+	// only mentioned in the text is not a link
+	if u.Path == "" || u.Path == "/" {
+		if !strings.Contains(original, "//") {
+			return original, ""
+		}
+		return "/", ""
+	}
+
+	var (
+		itemType string
+		oldID    string
+	)
+	switch path.Base(u.Path) {
+	case "showthread.php":
+		itemType, oldID = h.ItemTypeConversation, query.Get("t")
+		if p := query.Get("p"); p != "" {
+			itemType, oldID = h.ItemTypeComment, p
+		}
+	case "showpost.php":
+		itemType, oldID = h.ItemTypeComment, query.Get("p")
+	case "member.php":
+		itemType, oldID = h.ItemTypeProfile, query.Get("u")
+	case "forumdisplay.php":
+		itemType, oldID = h.ItemTypeMicrocosm, query.Get("f")
+	default:
+		if m := friendlyPath.FindStringSubmatch(u.Path); m != nil {
+			switch m[1] {
+			case "threads":
+				itemType = h.ItemTypeConversation
+			case "members":
+				itemType = h.ItemTypeProfile
+			case "forums":
+				itemType = h.ItemTypeMicrocosm
+			}
+			oldID = m[2]
+		}
+	}
+
+	// vBulletin also writes the ID as the first part of the query, i.e.
+	// showthread.php?123-title
+	if itemType != "" && oldID == "" {
+		oldID = strings.SplitN(u.RawQuery, "-", 2)[0]
+	}
+
+	if itemType == "" {
+		return "", "not a link to a forum, thread, post or member"
+	}
+
+	id, err := strconv.ParseInt(oldID, 10, 64)
+	if err != nil {
+		return "", "does not contain an ID"
+	}
+
+	newID, err := accounting.GetNewID(args.OriginID, h.ItemTypes[itemType], id)
+	if err != nil {
+		return "", fmt.Sprintf("could not look up %s %d: %v", itemType, id, err)
+	}
+	if newID == 0 {
+		return "", fmt.Sprintf("%s %d was not imported", itemType, id)
+	}
+
+	switch itemType {
+	case h.ItemTypeConversation:
+		return fmt.Sprintf("/conversations/%d/", newID), ""
+	case h.ItemTypeComment:
+		return fmt.Sprintf("/comments/%d/", newID), ""
+	case h.ItemTypeProfile:
+		return fmt.Sprintf("/profiles/%d/", newID), ""
+	default:
+		return fmt.Sprintf("/microcosms/%d/", newID), ""
+	}
+}
+
+// reportUnresolvedLinks writes the links that could not be rewritten to a file
+// in the export root, sorted by comment, and prints how many there were
+func reportUnresolvedLinks(args Args) error {
+	unresolvedLinksLock.Lock()
+	defer unresolvedLinksLock.Unlock()
+
+	sort.Sort(unresolvedLinksByComment(unresolvedLinks))
+
+	report := path.Join(
+		args.RootPath,
+		fmt.Sprintf("unresolved_links_%d.json", args.OriginID),
+	)
+
+	bytes, err := json.MarshalIndent(unresolvedLinks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(report, bytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d links could not be rewritten, see %s\n", len(unresolvedLinks), report)
+	glog.Infof("%d links could not be rewritten, see %s", len(unresolvedLinks), report)
+
+	return nil
+}
+
+// unresolvedLinksByComment sorts unresolved links by comment ID
+type unresolvedLinksByComment []unresolvedLink
+
+func (p unresolvedLinksByComment) Len() int { return len(p) }
+func (p unresolvedLinksByComment) Less(i, j int) bool {
+	return p[i].CommentID < p[j].CommentID
+}
+func (p unresolvedLinksByComment) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
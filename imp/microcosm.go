@@ -1,8 +1,12 @@
 package imp
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -12,13 +16,50 @@ import (
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
+	"github.com/microcosm-cc/import-schemas/config"
 	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
+// forum is an exported forum with the fields that src.Forum does not have
+type forum struct {
+	src.Forum
+
+	// ParentID is the ID of the forum that contains this one, or 0 if it is a
+	// top level forum
+	ParentID int64 `json:"parentId,omitempty"`
+
+	// DateCreated is when the forum was created, and is zero when the export
+	// does not say
+	DateCreated time.Time `json:"dateCreated,omitempty"`
+}
+
+// fallbackForum is a forum whose microcosm is owned by the fallback owner as
+// its author was not imported
+type fallbackForum struct {
+	ID     int64
+	Name   string
+	Author int64
+}
+
+var (
+	fallbackForums     []fallbackForum
+	fallbackForumsLock sync.Mutex
+)
+
+// forumParents[oldID] = old ID of the forum that the microcosm for the forum is
+// nested beneath once the hierarchy has been flattened, or 0 for the top level.
+// It is built before any forum is imported and is only read by the tasks.
+var forumParents = make(map[int64]int64)
+
 // importMicrocosms iterates a the export directory, storing each forums
-// individually
-func importMicrocosms(args conc.Args, gophers int) (errors []error) {
+// individually. The forums are imported a level of the hierarchy at a time so
+// that the microcosm of a parent forum always exists before its children.
+func importMicrocosms(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) (errors []error) {
 
 	// Forums
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeMicrocosm]
@@ -31,26 +72,165 @@ func importMicrocosms(args conc.Args, gophers int) (errors []error) {
 		exitWithError(err, errors)
 	}
 
-	return conc.RunTasks(
-		files.GetIDs(args.ItemTypeID),
-		args,
-		importMicrocosm,
-		gophers,
+	levels, err := forumLevels(args)
+	if err != nil {
+		exitWithError(err, errors)
+	}
+
+	for depth, ids := range levels {
+		glog.Infof("Importing %d forums at depth %d", len(ids), depth+1)
+
+		errors = append(
+			errors,
+			runTasks(ctx, ids, args, importMicrocosm, gophers)...,
+		)
+
+		// Children of forums that failed would fail too
+		if ctx.Err() != nil || (len(errors) > 0 && !args.ContinueOnError) {
+			break
+		}
+	}
+
+	reportFallbackForums()
+
+	return errors
+}
+
+// reportFallbackForums lists the forums whose microcosms were given to the
+// fallback owner
+func reportFallbackForums() {
+	fallbackForumsLock.Lock()
+	defer fallbackForumsLock.Unlock()
+
+	if len(fallbackForums) == 0 {
+		return
+	}
+
+	sort.Sort(fallbackForumsByID(fallbackForums))
+
+	fmt.Printf(
+		"%d forums are owned by the %s as their authors were not imported:\n",
+		len(fallbackForums),
+		strings.Replace(config.ForumFallbackOwner, "_", " ", -1),
 	)
+	for _, f := range fallbackForums {
+		fmt.Printf("  forum %d %q, author %d\n", f.ID, f.Name, f.Author)
+		glog.Warningf(
+			"Forum %d %q is owned by the %s as author %d was not imported",
+			f.ID,
+			f.Name,
+			config.ForumFallbackOwner,
+			f.Author,
+		)
+	}
 }
 
-func importMicrocosm(args conc.Args, itemID int64) error {
+// fallbackForumsByID sorts fallback forums by ID
+type fallbackForumsByID []fallbackForum
+
+func (p fallbackForumsByID) Len() int           { return len(p) }
+func (p fallbackForumsByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p fallbackForumsByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// forumLevels reads the hierarchy of every forum in the export and returns the
+// IDs of the forums to import grouped by their depth once flattened, each
+// group sorted by display order. It also fills forumParents.
+func forumLevels(args Args) ([][]int64, error) {
+	allIDs, err := files.GetIDs(args.ItemTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[int64]int64)
+	displayOrders := make(map[int64]int64)
+	for _, id := range allIDs {
+		f := forum{}
+		err := files.JSONFileToInterface(
+			files.GetPath(args.ItemTypeID, id),
+			&f,
+		)
+		if err != nil {
+			glog.Errorf("Failed to load forum from JSON: %+v", err)
+			return nil, err
+		}
+
+		parents[id] = f.ParentID
+		displayOrders[id] = f.DisplayOrder
+	}
+
+	// ancestors returns the IDs of the forums above a forum, top level first
+	ancestors := func(id int64) []int64 {
+		chain := []int64{}
+		for parentID := parents[id]; parentID > 0; parentID = parents[parentID] {
+			if _, ok := parents[parentID]; !ok {
+				glog.Warningf(
+					"Parent forum %d of forum %d is not in the export, the "+
+						"forums beneath it are imported as though it were the "+
+						"top level",
+					parentID,
+					id,
+				)
+				break
+			}
+			if len(chain) > len(parents) {
+				glog.Warningf(
+					"Forum %d is within a cycle of parents, importing it at "+
+						"the top level",
+					id,
+				)
+				return []int64{}
+			}
+			chain = append([]int64{parentID}, chain...)
+		}
+		return chain
+	}
+
+	levels := [][]int64{}
+	for _, id := range getIDs(args) {
+		chain := ancestors(id)
+		if config.ForumFlattenDepth > 0 &&
+			int64(len(chain)) >= config.ForumFlattenDepth {
+
+			chain = chain[:config.ForumFlattenDepth-1]
+		}
+
+		forumParents[id] = 0
+		if len(chain) > 0 {
+			forumParents[id] = chain[len(chain)-1]
+		}
+
+		for len(levels) <= len(chain) {
+			levels = append(levels, []int64{})
+		}
+		levels[len(chain)] = append(levels[len(chain)], id)
+	}
+
+	for _, ids := range levels {
+		sort.SliceStable(ids, func(i, j int) bool {
+			return displayOrders[ids[i]] < displayOrders[ids[j]]
+		})
+	}
+
+	return levels, nil
+}
+
+func importMicrocosm(args Args, itemID int64) error {
 
 	// Skip when it already exists
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		if glog.V(2) {
 			glog.Infof("Skipping forum %d", itemID)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
-	srcForum := src.Forum{}
-	err := files.JSONFileToInterface(
+	srcForum := forum{}
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&srcForum,
 	)
@@ -59,22 +239,86 @@ func importMicrocosm(args conc.Args, itemID int64) error {
 		return err
 	}
 
-	createdByID := accounting.GetNewID(
+	var parentID int64
+	if oldParentID := forumParents[itemID]; oldParentID > 0 {
+		parentID, err = accounting.GetNewID(args.OriginID, args.ItemTypeID, oldParentID)
+		if err != nil {
+			return err
+		}
+		if parentID == 0 {
+			return fmt.Errorf(
+				`Cannot find existing microcosm for parent forum %d of src forum %d`,
+				oldParentID,
+				srcForum.ID,
+			)
+		}
+	}
+
+	createdByID, err := accounting.GetNewID(
 		args.OriginID,
 		h.ItemTypes[h.ItemTypeProfile],
 		srcForum.Author,
 	)
-	if createdByID == 0 {
-		return fmt.Errorf(
-			`Cannot find existing user for src author %d for src forum %d`,
-			srcForum.Author,
-			srcForum.ID,
+	if err != nil {
+		return err
+	}
+	usedFallback := createdByID == 0
+	if usedFallback {
+		createdByID = args.SiteOwnerProfileID
+		if config.ForumFallbackOwner == config.ForumFallbackOwnerDeleted {
+			createdByID = args.DeletedProfileID
+		}
+	}
+
+	created := srcForum.DateCreated
+	if created.IsZero() {
+		created = fallbackCreated(args, itemID)
+	}
+
+	orphanID, err := beginCreate(args, srcForum.ID, target.Orphan{
+		ItemTypeID:  args.ItemTypeID,
+		SiteID:      args.SiteID,
+		ParentID:    parentID,
+		Title:       srcForum.Name,
+		CreatedByID: createdByID,
+		Created:     created,
+	})
+	if err != nil {
+		return err
+	}
+
+	title := srcForum.Name
+	if config.ForumConflict != config.ForumConflictCreate && orphanID == 0 {
+		existingID, err := args.Target.FindMicrocosm(
+			args.SiteID,
+			args.OriginID,
+			srcForum.Name,
 		)
+		if err != nil {
+			glog.Errorf("Failed to find microcosm %s: %+v", srcForum.Name, err)
+			return err
+		}
+
+		if existingID > 0 {
+			switch config.ForumConflict {
+			case config.ForumConflictMerge:
+				glog.Infof(
+					"Merging forum %d into existing microcosm %d",
+					srcForum.ID,
+					existingID,
+				)
+				return mergeMicrocosm(args, srcForum.ID, existingID)
+
+			case config.ForumConflictRename:
+				title = fmt.Sprintf("%s (%s)", srcForum.Name, config.Source)
+				glog.Infof("Renaming forum %d to %s", srcForum.ID, title)
+			}
+		}
 	}
 
 	m := models.MicrocosmType{}
 	m.SiteId = args.SiteID
-	m.Title = srcForum.Name
+	m.Title = title
 	if strings.TrimSpace(srcForum.Text) != "" {
 		m.Description = srcForum.Text
 	} else {
@@ -82,7 +326,7 @@ func importMicrocosm(args conc.Args, itemID int64) error {
 	}
 	m.OwnedById = createdByID
 
-	m.Meta.Created = time.Now()
+	m.Meta.Created = created
 	m.Meta.CreatedById = createdByID
 
 	m.Meta.Flags.Open = srcForum.Open
@@ -91,43 +335,50 @@ func importMicrocosm(args conc.Args, itemID int64) error {
 	m.Meta.Flags.Deleted = srcForum.Deleted
 	m.Meta.Flags.Visible = true
 
-	_, err = m.Import()
+	if orphanID > 0 {
+		m.Id = orphanID
+	} else {
+		err = args.Target.CreateMicrocosm(&m)
+		if err != nil {
+			glog.Errorf(
+				"Failed to create microcosm for microcosm %d: %+v",
+				srcForum.ID,
+				err,
+			)
+			return err
+		}
+	}
+
+	err = args.Target.PlaceMicrocosm(m.Id, parentID, srcForum.DisplayOrder)
 	if err != nil {
 		glog.Errorf(
-			"Failed to create microcosm for microcosm %d: %+v",
+			"Failed to place microcosm for microcosm %d: %+v",
 			srcForum.ID,
 			err,
 		)
 		return err
 	}
 
-	tx, err := h.GetTransaction()
-	if err != nil {
-		glog.Errorf("Failed to get transaction: %+v", err)
-		return err
-	}
-	defer tx.Rollback()
-
-	if err != nil {
-		glog.Errorf("Failed to createMicrocosm for forum %d: %+v", itemID, err)
-		return err
-	}
-	err = accounting.RecordImport(
-		tx,
+	err = args.Target.RecordImport(
 		args.OriginID,
 		args.ItemTypeID,
 		srcForum.ID,
 		m.Id,
 	)
 	if err != nil {
-		glog.Errorf("Failed to recordImport: %+v", err)
 		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		glog.Errorf("Failed to commit transaction: %+v", err)
-		return err
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
+
+	if usedFallback {
+		fallbackForumsLock.Lock()
+		fallbackForums = append(fallbackForums, fallbackForum{
+			ID:     srcForum.ID,
+			Name:   srcForum.Name,
+			Author: srcForum.Author,
+		})
+		fallbackForumsLock.Unlock()
 	}
 
 	if glog.V(2) {
@@ -135,3 +386,56 @@ func importMicrocosm(args conc.Args, itemID int64) error {
 	}
 	return nil
 }
+
+// fallbackCreated returns when a forum that does not say when it was created
+// is taken to have been, being when the export was made or failing that when
+// the file of the forum was written. It is the same on every run, so that the
+// microcosm created by an interrupted run can be found by it, and is no more
+// precise than the database.
+func fallbackCreated(args Args, itemID int64) time.Time {
+	if !args.Exported.IsZero() {
+		return args.Exported.Truncate(time.Microsecond)
+	}
+
+	info, err := os.Stat(files.GetPath(args.ItemTypeID, itemID))
+	if err != nil {
+		glog.Errorf("Failed to stat forum %d: %+v", itemID, err)
+		return time.Now()
+	}
+
+	return info.ModTime().Truncate(time.Microsecond)
+}
+
+// mergeMicrocosm records that a forum was imported as a microcosm that already
+// existed, so that the conversations of the forum are imported into it
+func mergeMicrocosm(args Args, oldID int64, microcosmID int64) error {
+	// A microcosm that no origin imported existed before the import, and is
+	// recorded as such so that rolling back the import keeps it
+	if !args.DryRun {
+		imported, err := accounting.IsImported(args.ItemTypeID, microcosmID)
+		if err != nil {
+			glog.Errorf("Failed to check imports of microcosm %d: %+v", microcosmID, err)
+			return err
+		}
+		if !imported {
+			err = args.Target.RecordExisting(args.ItemTypeID, microcosmID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := args.Target.RecordImport(
+		args.OriginID,
+		args.ItemTypeID,
+		oldID,
+		microcosmID,
+	)
+	if err != nil {
+		return err
+	}
+
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package imp
+
+import (
+	"github.com/golang/glog"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/target"
+)
+
+// beginCreate is called before an item is created. When a prior run of the
+// import was interrupted whilst creating the item it returns the ID of the item
+// that the run created, if it finds one, which should be adopted instead of
+// creating the item again. Otherwise it records the intent to create the item
+// and returns 0.
+func beginCreate(args Args, oldID int64, o target.Orphan) (int64, error) {
+	if accounting.Interrupted(o.ItemTypeID, oldID) {
+		itemID, err := args.Target.FindOrphan(o)
+		if err != nil {
+			glog.Errorf("Failed to find orphan of %d: %+v", oldID, err)
+			return 0, err
+		}
+
+		if itemID > 0 {
+			glog.Infof("Adopting item %d as the import of %d", itemID, oldID)
+			return itemID, nil
+		}
+	}
+
+	return 0, args.Target.RecordIntent(args.OriginID, o.ItemTypeID, oldID)
+}
@@ -0,0 +1,261 @@
+package imp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/config"
+	"github.com/microcosm-cc/import-schemas/files"
+)
+
+// phase is a step of the import that imports every item of a single type
+type phase struct {
+	// Name is used to select the phase with -only and -skip
+	Name string
+
+	// ItemType is the item type imported by the phase, i.e. h.ItemTypeComment,
+	// and is empty for phases that change items that are already imported
+	ItemType string
+
+	// Requires are the phases that must have been imported before this one
+	Requires []string
+
+	// Finalise is true for phases that are not repeatable, and so only run
+	// when the import is finalised
+	Finalise bool
+
+	// Run imports the items
+	Run func(ctx context.Context, args Args, gophers int) []error
+
+	// StopOnCancelOnly is true when failures of this phase do not prevent the
+	// phases that follow from running
+	StopOnCancelOnly bool
+}
+
+// phases are all of the steps of an import in the order that they run, ensuring
+// that any dependencies are imported before they are needed
+var phases = []phase{
+	{
+		Name:     "profiles",
+		ItemType: h.ItemTypeProfile,
+		Run:      importProfiles,
+	},
+	{
+		Name:     "microcosms",
+		ItemType: h.ItemTypeMicrocosm,
+		Requires: []string{"profiles"},
+		Run:      importMicrocosms,
+	},
+	{
+		Name:     "conversations",
+		ItemType: h.ItemTypeConversation,
+		Requires: []string{"profiles", "microcosms"},
+		Run:      importConversations,
+	},
+	{
+		Name:     "comments",
+		ItemType: h.ItemTypeComment,
+		Requires: []string{"profiles", "conversations"},
+		Run:      importComments,
+	},
+	{
+		Name:     "huddles",
+		ItemType: h.ItemTypeHuddle,
+		Requires: []string{"profiles"},
+		Run:      importHuddles,
+	},
+	// Can be highly concurrent as nearly all activity here is going to be disk
+	// and network limited... perhaps 100+ gophers? See config.Gophers
+	{
+		Name:             "attachments",
+		ItemType:         h.ItemTypeAttachment,
+		Requires:         []string{"profiles", "comments"},
+		Run:              importAttachments,
+		StopOnCancelOnly: true,
+	},
+	// Links can only be rewritten once the items that they link to have been
+	// imported, and may link to any comment
+	{
+		Name:             "links",
+		Requires:         []string{"comments"},
+		Run:              rewriteLinks,
+		StopOnCancelOnly: true,
+	},
+	{
+		Name:             "follows",
+		ItemType:         h.ItemTypeWatcher,
+		Requires:         []string{"profiles", "microcosms", "conversations"},
+		Finalise:         true,
+		Run:              importFollows,
+		StopOnCancelOnly: true,
+	},
+	// Roles must be the very last thing we do, as once we add permissions we
+	// will be securing the site and a lot of the prior imports would fail if
+	// the permissions today didn't precisely match the permissions at the time
+	// that content was created... which is extremely unlikely.
+	//
+	// As a result, we shouldn't import roles until we are sure we got here
+	// without error, as roles will reduce the overall resumability of an import
+	{
+		Name:     "roles",
+		ItemType: h.ItemTypeRole,
+		Requires: []string{"profiles", "microcosms"},
+		Finalise: true,
+		Run: func(ctx context.Context, args Args, gophers int) []error {
+			return importRoles(args, gophers)
+		},
+	},
+}
+
+// getPhase returns the phase with the given name
+func getPhase(name string) (phase, bool) {
+	for _, p := range phases {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return phase{}, false
+}
+
+// selectPhases returns the names of the phases to run. only and skip are comma
+// separated lists of phase names, when only is given just those phases are run
+// and otherwise every phase except those in skip is run. The finalise phases
+// are only run when finalise is true or when they are named in only.
+func selectPhases(only string, skip string, finalise bool) (map[string]bool, error) {
+	if only != "" && skip != "" {
+		return nil, fmt.Errorf("Cannot use -only and -skip together")
+	}
+
+	onlyNames, err := parsePhaseNames(only)
+	if err != nil {
+		return nil, err
+	}
+	skipNames, err := parsePhaseNames(skip)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]bool)
+	for _, p := range phases {
+		switch {
+		case only != "":
+			if !onlyNames[p.Name] {
+				continue
+			}
+		case skipNames[p.Name]:
+			continue
+		case p.Finalise && !finalise:
+			continue
+		}
+
+		selected[p.Name] = true
+	}
+
+	return selected, nil
+}
+
+func parsePhaseNames(names string) (map[string]bool, error) {
+	parsed := make(map[string]bool)
+	if names == "" {
+		return parsed, nil
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := getPhase(name); !ok {
+			return nil, fmt.Errorf("Unknown phase: %s", name)
+		}
+		parsed[name] = true
+	}
+
+	return parsed, nil
+}
+
+// checkRequirements returns an error if a selected phase requires a phase that
+// is not selected and has not already been imported by this origin. The prior
+// imports must have been loaded before this is called.
+func checkRequirements(
+	rootPath string,
+	originID int64,
+	selected map[string]bool,
+) error {
+
+	for _, p := range phases {
+		if !selected[p.Name] {
+			continue
+		}
+
+		for _, name := range p.Requires {
+			if selected[name] {
+				continue
+			}
+
+			required, _ := getPhase(name)
+			itemTypeID := h.ItemTypes[required.ItemType]
+
+			// Nothing to have imported if the export does not contain any
+			if !files.ExportExists(rootPath, itemTypeID) {
+				continue
+			}
+
+			var (
+				imported bool
+				err      error
+			)
+			if required.ItemType == h.ItemTypeProfile {
+				imported, err = profilesImported(originID)
+			} else {
+				var count int
+				count, err = accounting.CountImports(originID, itemTypeID)
+				imported = count > 0
+			}
+			if err != nil {
+				return err
+			}
+			if !imported {
+				return fmt.Errorf(
+					"Cannot import %s as %s have not been imported",
+					p.Name,
+					name,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// profilesImported returns true if any exported profile other than the site
+// owner has been imported by this origin. The owner and the deleted profile are
+// recorded before any phase runs, and so the number of profiles imported does
+// not show whether the profiles phase has been. The profiles must have been
+// loaded before this is called.
+func profilesImported(originID int64) (bool, error) {
+
+	itemTypeID := h.ItemTypes[h.ItemTypeProfile]
+
+	ids, err := files.GetIDs(itemTypeID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range ids {
+		if id == config.SiteOwnerID {
+			continue
+		}
+		imported, err := accounting.GetNewID(originID, itemTypeID, id)
+		if err != nil {
+			return false, err
+		}
+		if imported > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
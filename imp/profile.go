@@ -1,25 +1,21 @@
 package imp
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"net"
-	"net/http"
 	"path"
 	"strings"
 
 	"github.com/golang/glog"
 
 	src "github.com/microcosm-cc/export-schemas/go/forum"
-	"github.com/microcosm-cc/microcosm/audit"
 	h "github.com/microcosm-cc/microcosm/helpers"
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
-	"github.com/microcosm-cc/import-schemas/config"
 	"github.com/microcosm-cc/import-schemas/files"
 )
 
@@ -57,20 +53,20 @@ func loadProfiles(rootPath string, ownerID int64) (src.Profile, error) {
 }
 
 // createDeletedProfile to own all of the orphaned content we find
-func createDeletedProfile(args conc.Args) (int64, error) {
+func createDeletedProfile(args Args) (int64, error) {
 
 	sp := src.Profile{
 		Email: "deleted@microcosm.cc",
 		Name:  "deleted",
 	}
 
-	profile, err := createProfile(args, sp)
+	profile, _, err := args.Target.CreateProfile(args.SiteID, sp)
 	if err != nil {
 		glog.Errorf("Failed to get existing user by email address: %+v", err)
 		return 0, err
 	}
 
-	accounting.AddDeletedProfileID(profile.Id)
+	accounting.AddDeletedProfileID(args.OriginID, profile.Id)
 
 	if glog.V(2) {
 		glog.Infof("Successfully create deleted profile %d", profile.Id)
@@ -79,7 +75,11 @@ func createDeletedProfile(args conc.Args) (int64, error) {
 }
 
 // importProfiles iterates the profiles and imports each individually
-func importProfiles(args conc.Args, gophers int) []error {
+func importProfiles(
+	ctx context.Context,
+	args Args,
+	gophers int,
+) []error {
 
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeProfile]
 
@@ -87,14 +87,16 @@ func importProfiles(args conc.Args, gophers int) []error {
 	// figure out our dupes and do things in two passes with high concurrency,
 	// otherwise we need to do everything sequentially in a single process.
 
-	indexFile := path.Join(config.Rootpath, src.ProfilesPath, "index.json")
-	if !files.Exists(indexFile) {
-		// Index file did not exist, sequential it is.
+	indexFile := path.Join(args.RootPath, src.ProfilesPath, "index.json")
+	if !files.Exists(indexFile) || args.RetryFailures {
+		// Index file did not exist, or we are only retrying the few profiles
+		// that failed, sequential it is.
 		fmt.Println("Importing profiles...")
 		glog.Info("Importing profiles...")
 
-		return conc.RunTasks(
-			files.GetIDs(args.ItemTypeID),
+		return runTasks(
+			ctx,
+			getIDs(args),
 			args,
 			importProfile,
 			1,
@@ -126,19 +128,24 @@ func importProfiles(args conc.Args, gophers int) []error {
 		firstPass = append(firstPass, df.ID)
 	}
 
-	errs := conc.RunTasks(firstPass, args, importProfile, gophers)
+	errs := runTasks(ctx, firstPass, args, importProfile, gophers)
 	return append(
 		errs,
-		conc.RunTasks(secondPass, args, importProfile, gophers)...,
+		runTasks(ctx, secondPass, args, importProfile, gophers)...,
 	)
 }
 
-func importProfile(args conc.Args, itemID int64) error {
+func importProfile(args Args, itemID int64) error {
 	// Skip when it already exists
-	if accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID) > 0 {
+	imported, err := accounting.GetNewID(args.OriginID, args.ItemTypeID, itemID)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
 		if glog.V(2) {
 			glog.Infof("Skipping profile %d", itemID)
 		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Skipped)
 		return nil
 	}
 
@@ -147,7 +154,7 @@ func importProfile(args conc.Args, itemID int64) error {
 	// Done here so that if we are resuming and only a few failed we only end up
 	// reading a few things from disk rather than everything.
 	sp := src.Profile{}
-	err := files.JSONFileToInterface(
+	err = files.JSONFileToInterface(
 		files.GetPath(args.ItemTypeID, itemID),
 		&sp,
 	)
@@ -156,54 +163,74 @@ func importProfile(args conc.Args, itemID int64) error {
 		return err
 	}
 
-	profile, err := createProfile(args, sp)
+	// A profile that existed before any import is adopted by email address,
+	// and is recorded as such along with the intent so that rolling back the
+	// import keeps it. When the import of the profile was interrupted both
+	// were recorded by the interrupted run, and a profile that exists now but
+	// was not recorded as existing was created by that run.
+	if !accounting.Interrupted(args.ItemTypeID, sp.ID) {
+		err = args.Target.RecordProfileIntent(args.SiteID, args.OriginID, sp)
+		if err != nil {
+			glog.Errorf("Failed to record intent for profile %d: %+v", itemID, err)
+			return err
+		}
+	}
+
+	profile, _, err := args.Target.CreateProfile(args.SiteID, sp)
 	if err != nil {
 		glog.Errorf("Failed to createProfile %d : %+v", itemID, err)
 		return err
 	}
 
-	if sp.Avatar.ContentURL != "" {
+	// Profiles are unique per email address, so when another origin has already
+	// imported a profile with this email address it is shared by both
+	var merged bool
+	if !args.DryRun {
+		otherOriginID, err := accounting.GetOtherOrigin(
+			args.OriginID,
+			args.ItemTypeID,
+			profile.Id,
+		)
+		if err != nil {
+			glog.Errorf("Failed to check origins of profile %d: %+v", itemID, err)
+			return err
+		}
+		if otherOriginID > 0 {
+			glog.Warningf(
+				"Profile %d shares email address %s with profile %d imported "+
+					"by origin %d, merging",
+				itemID,
+				sp.Email,
+				profile.Id,
+				otherOriginID,
+			)
+			merged = true
+		}
+	}
+
+	// The profile keeps the avatar it already had when merged
+	if sp.Avatar.ContentURL != "" && !merged {
 		glog.Infof("Processing avatar for %v", profile)
-		err := processAvatar(sp, profile)
+		err := processAvatar(args, sp, profile)
 		// Avatar processing errors are not fatal, so don't return.
 		if err != nil {
 			glog.Errorf("Error processing avatar: %s", err)
 		}
 	}
 
-	tx, err := h.GetTransaction()
-	if err != nil {
-		glog.Errorf("Failed to get transaction: %+v", err)
-		return err
-	}
-	defer tx.Rollback()
-
-	err = accounting.RecordImport(
-		tx,
+	err = args.Target.RecordImport(
 		args.OriginID,
 		args.ItemTypeID,
 		sp.ID,
 		profile.Id,
 	)
 	if err != nil {
-		glog.Errorf("Failed to recordImport: %+v", err)
 		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		glog.Errorf("Failed to commit transaction: %+v", err)
-		return err
-	}
+	args.Target.AuditProfile(args.SiteID, profile.Id, sp)
 
-	audit.Create(
-		args.SiteID,
-		h.ItemTypes[h.ItemTypeProfile],
-		profile.Id,
-		profile.Id,
-		sp.DateCreated,
-		net.ParseIP(sp.IPAddress),
-	)
+	accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
 
 	if glog.V(2) {
 		glog.Infof("Successfully imported profile %d", itemID)
@@ -211,74 +238,11 @@ func importProfile(args conc.Args, itemID int64) error {
 	return nil
 }
 
-// createProfile puts a profile into the database via microcosm models
-func createProfile(args conc.Args, sp src.Profile) (models.ProfileType, error) {
-
-	u, status, err := models.GetUserByEmailAddress(sp.Email)
-	if err != nil && status != http.StatusNotFound {
-		glog.Errorf(
-			"Failed to get existing user by email address: <%s> %+v",
-			sp.Email,
-			err,
-		)
-		return models.ProfileType{}, err
-	}
-	if status == http.StatusNotFound {
-		glog.Infof("Creating new user for email address: %s", sp.Email)
-		// User doesn't exist, so we should create it
-		u = models.UserType{}
-		u.Email = sp.Email
-		u.Language = "en-GB"
-
-		_, err := u.Insert()
-		if err != nil {
-			glog.Errorf("Failed to create user for profile: %+v", err)
-			return models.ProfileType{}, err
-		}
-	} else {
-		// User does exist, so we should check whether that user already has a
-		// profile on this site and return that.
-		profileID, status, err := models.GetProfileId(args.SiteID, u.ID)
-		if err != nil && status != http.StatusNotFound {
-			glog.Errorf("Failed to get existing profile for user: %+v", err)
-			return models.ProfileType{}, err
-		}
-		// If profile ID exists, fetch full profile and return. Otherwise,
-		// a new profile is created below.
-		if status == http.StatusOK {
-			profile, _, err := models.GetProfile(args.SiteID, profileID)
-			if err != nil {
-				glog.Errorf("Failed to retrieve existing profile %d: %s", profileID, err)
-			}
-			return profile, nil
-		}
-	}
-
-	glog.Infof("Creating new profile: user: %d", u.ID)
-	// We don't have a profile, but we do now have a user, so create the profile
-	p := models.ProfileType{}
-	p.SiteId = args.SiteID
-	p.UserId = u.ID
-	p.ProfileName = sp.Name
-	p.Created = sp.DateCreated
-	p.LastActive = sp.LastActive
-	p.Visible = true
-	p.StyleId = 1
-	p.AvatarUrlNullable = sql.NullString{
-		String: "/api/v1/files/66cca61feb8001cb71a9fb7062ff94c9d2543340",
-		Valid:  true,
-	}
-
-	_, err = p.Import()
-	if err != nil {
-		glog.Errorf("Failed to create profile for imported user %d: %+v", sp.ID, err)
-		return p, err
-	}
-
-	return p, nil
-}
-
-func processAvatar(sp src.Profile, profile models.ProfileType) error {
+func processAvatar(
+	args Args,
+	sp src.Profile,
+	profile models.ProfileType,
+) error {
 
 	// Create and associate profile avatar.
 	// Use FileMetadata.Import which idempotently creates necessary row.
@@ -315,8 +279,7 @@ func processAvatar(sp src.Profile, profile models.ProfileType) error {
 	}
 	fm.FileHash = SHA1
 
-	max := int64(1)<<32 - 1
-	_, err = fm.Import(max, max)
+	err = args.Target.CreateFileMetadata(&fm)
 	if err != nil {
 		glog.Errorf(fmt.Sprintf("profileID: %d : %s", profile.Id, err))
 		return err
@@ -345,7 +308,7 @@ func processAvatar(sp src.Profile, profile models.ProfileType) error {
 		FileName:         sp.Avatar.Name,
 		Created:          sp.Avatar.DateCreated,
 	}
-	_, err = at.Import()
+	err = args.Target.CreateAttachment(&at)
 	if err != nil {
 		glog.Errorf("Could not import attachment %d\n", sp.Avatar.ID)
 		return err
@@ -364,7 +327,7 @@ func processAvatar(sp src.Profile, profile models.ProfileType) error {
 		glog.Errorf("%d", profile.SiteId)
 
 	}
-	_, err = profile.Update()
+	err = args.Target.UpdateProfile(&profile)
 	if err != nil {
 		glog.Errorf("Failed to update profile: %+v", err)
 		return err
@@ -0,0 +1,276 @@
+package imp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/config"
+	"github.com/microcosm-cc/import-schemas/files"
+)
+
+// drift is what reconciliation found for an item type
+type drift struct {
+	ItemType string `json:"itemType"`
+	Exported int64  `json:"exported"`
+	Mapped   int64  `json:"mapped"`
+
+	// Dangling are the old IDs of items recorded as imported that no longer
+	// exist
+	Dangling []int64 `json:"dangling"`
+
+	// Unmapped are the new IDs of items that belong to the import but that
+	// were not recorded as imported
+	Unmapped []int64 `json:"unmapped"`
+
+	// Interrupted are the old IDs of items that a run of the import was
+	// creating when it was interrupted
+	Interrupted []int64 `json:"interrupted"`
+}
+
+// Reconcile writes to w how imported_items for the import into the configured
+// site has drifted from the items that it points at, and returns the number of
+// problems found. The number of items recorded as imported is compared with
+// the number exported, though these may differ for good reasons such as
+// profiles sharing an email address or comments without a conversation.
+//
+// When repair is true the records of imports of items that no longer exist are
+// removed, and these items and the items of interrupted imports are added to
+// the failure ledger so that -retry-failures imports them again. Items that
+// were created without their import being recorded cannot be repaired, as
+// their old IDs are not known.
+//
+// The detail of what was found is written to a file in the export root.
+func Reconcile(rootPath string, repair bool, w io.Writer) (int64, error) {
+	siteID, _ := GetExistingSiteAndAdmin(config.SiteSubdomainKey)
+	if siteID == 0 {
+		fmt.Fprintf(w, "Site %s does not exist\n", config.SiteSubdomainKey)
+		return 0, nil
+	}
+
+	originID := GetImportInProgress(siteID, config.Source)
+	if originID == 0 {
+		fmt.Fprintf(
+			w,
+			"No import of %s into site %d has been started\n",
+			config.Source,
+			siteID,
+		)
+		return 0, nil
+	}
+
+	counts, err := accounting.CountImportedItems(originID)
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Fprintf(w, "Site: %d\nOrigin: %d\n\n", siteID, originID)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Phase\tExported\tMapped\tDangling\tUnmapped\tInterrupted\t")
+
+	var findings int64
+	drifts := []drift{}
+	for _, p := range phases {
+		// Nothing is imported by phases without an item type
+		if p.ItemType == "" {
+			continue
+		}
+
+		d, err := reconcileItemType(rootPath, originID, p.ItemType, counts)
+		if err != nil {
+			return findings, err
+		}
+		drifts = append(drifts, d)
+
+		findings += int64(len(d.Dangling) + len(d.Unmapped) + len(d.Interrupted))
+
+		canDangle, canUnmap := accounting.CanReconcile(p.ItemType)
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%d\t%s\t%s\t%d\t\n",
+			p.Name,
+			d.Exported,
+			d.Mapped,
+			countIf(canDangle, d.Dangling),
+			countIf(canUnmap, d.Unmapped),
+			len(d.Interrupted),
+		)
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return findings, err
+	}
+
+	report := path.Join(rootPath, fmt.Sprintf("reconcile_%d.json", originID))
+	bytes, err := json.MarshalIndent(drifts, "", "  ")
+	if err != nil {
+		return findings, err
+	}
+	err = ioutil.WriteFile(report, bytes, 0644)
+	if err != nil {
+		return findings, err
+	}
+	fmt.Fprintf(w, "\nThe items found are listed in %s\n", report)
+
+	if !repair || findings == 0 {
+		return findings, nil
+	}
+
+	// The imports that are forgotten must also be removed from the ID file
+	if config.IDStore == config.IDStoreDisk {
+		accounting.UseDiskStore(config.Rootpath)
+		defer accounting.CloseStore()
+	}
+
+	fmt.Fprintln(w)
+	for _, d := range drifts {
+		err = repairItemType(rootPath, originID, d, w)
+		if err != nil {
+			return findings, err
+		}
+	}
+
+	return findings, nil
+}
+
+// reconcileItemType finds the drift of a single item type
+func reconcileItemType(
+	rootPath string,
+	originID int64,
+	itemType string,
+	counts map[int64]int64,
+) (
+	drift,
+	error,
+) {
+
+	itemTypeID := h.ItemTypes[itemType]
+	d := drift{
+		ItemType:    itemType,
+		Mapped:      counts[itemTypeID],
+		Dangling:    []int64{},
+		Unmapped:    []int64{},
+		Interrupted: []int64{},
+	}
+
+	var err error
+	if files.ExportExists(rootPath, itemTypeID) {
+		d.Exported, err = files.CountIDs(rootPath, itemTypeID)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	canDangle, canUnmap := accounting.CanReconcile(itemType)
+	if canDangle {
+		d.Dangling, err = accounting.GetDanglingImports(originID, itemType)
+		if err != nil {
+			return d, err
+		}
+	}
+	if canUnmap {
+		d.Unmapped, err = accounting.GetUnmappedItems(originID, itemType)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	d.Interrupted, err = accounting.GetIntents(originID, itemTypeID)
+	if err != nil {
+		return d, err
+	}
+
+	return d, nil
+}
+
+// repairItemType forgets the imports of items that no longer exist, and adds
+// them and the items of interrupted imports to the failure ledger
+func repairItemType(
+	rootPath string,
+	originID int64,
+	d drift,
+	w io.Writer,
+) error {
+
+	if len(d.Dangling) == 0 && len(d.Interrupted) == 0 {
+		return nil
+	}
+
+	// Roles are not imported item by item, so cannot be retried
+	if d.ItemType == h.ItemTypeRole {
+		fmt.Fprintln(w, "Roles cannot be repaired, import them again with -finalise")
+		return nil
+	}
+
+	itemTypeID := h.ItemTypes[d.ItemType]
+
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.ForgetImports(tx, originID, itemTypeID, d.Dangling)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = accounting.ForgetDiskImports(originID, itemTypeID, d.Dangling)
+	if err != nil {
+		return err
+	}
+
+	failures := []accounting.Failure{}
+	for _, oldID := range d.Dangling {
+		failures = append(failures, accounting.Failure{
+			OldID: oldID,
+			Error: "The imported item no longer exists",
+		})
+	}
+	for _, oldID := range d.Interrupted {
+		failures = append(failures, accounting.Failure{
+			OldID: oldID,
+			Error: "The import was interrupted whilst creating the item",
+		})
+	}
+
+	err = accounting.AddFailures(rootPath, originID, itemTypeID, failures)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(
+		w,
+		"Queued %d %s items, import them with -retry-failures=%s\n",
+		len(failures),
+		d.ItemType,
+		d.ItemType,
+	)
+	glog.Infof("Queued %d %s items for import", len(failures), d.ItemType)
+
+	return nil
+}
+
+// countIf returns the number of IDs, or n/a if they could not be found
+func countIf(checked bool, ids []int64) string {
+	if !checked {
+		return "n/a"
+	}
+
+	return fmt.Sprintf("%d", len(ids))
+}
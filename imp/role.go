@@ -12,8 +12,8 @@ import (
 	"github.com/microcosm-cc/microcosm/models"
 
 	"github.com/microcosm-cc/import-schemas/accounting"
-	"github.com/microcosm-cc/import-schemas/conc"
 	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/target"
 )
 
 var (
@@ -24,7 +24,7 @@ var (
 	defaultRoles = make(map[int64]bool)
 )
 
-func importRoles(args conc.Args, gophers int) []error {
+func importRoles(args Args, gophers int) []error {
 
 	args.ItemTypeID = h.ItemTypes[h.ItemTypeRole]
 
@@ -50,8 +50,18 @@ func importRoles(args conc.Args, gophers int) []error {
 		exitWithError(err, []error{})
 	}
 
+	// The forums will not have been walked if the microcosms were imported by
+	// an earlier run
+	err = files.WalkExportTree(args.RootPath, h.ItemTypes[h.ItemTypeMicrocosm])
+	if err != nil {
+		exitWithError(err, []error{})
+	}
+
 	// 1.2 Load roles into a slice of fully constructed roles
-	oldRoleIDS := files.GetIDs(args.ItemTypeID)
+	oldRoleIDS, err := files.GetIDs(args.ItemTypeID)
+	if err != nil {
+		exitWithError(err, []error{})
+	}
 
 	for _, oldRoleId := range oldRoleIDS {
 		srcRole := src.Role{}
@@ -88,11 +98,14 @@ func importRoles(args conc.Args, gophers int) []error {
 
 		for _, u := range srcRole.Users {
 
-			profileId := accounting.GetNewID(
+			profileId, err := accounting.GetNewID(
 				args.OriginID,
 				h.ItemTypes[h.ItemTypeProfile],
 				u.ID,
 			)
+			if err != nil {
+				return []error{err}
+			}
 			if profileId == 0 {
 				continue
 			}
@@ -150,37 +163,40 @@ func importRoles(args conc.Args, gophers int) []error {
 			continue
 		}
 
-		_, err := role.Insert(args.SiteID, args.SiteOwnerProfileID)
+		// The criteria of an adopted role are kept, and its members are
+		// added again
+		orphanID, err := beginCreate(args, oldRoleId, target.Orphan{
+			ItemTypeID: args.ItemTypeID,
+			SiteID:     args.SiteID,
+			Title:      role.Title,
+		})
 		if err != nil {
-			glog.Errorf("%s %+v", err, role)
 			return []error{err}
 		}
 
-		for _, c := range role.Criteria {
-			_, err := c.Insert(role.Id)
+		if orphanID > 0 {
+			role.Id = orphanID
+		} else {
+			err = args.Target.CreateRole(
+				args.SiteID,
+				args.SiteOwnerProfileID,
+				&role,
+			)
 			if err != nil {
-				glog.Error(err)
+				glog.Errorf("%s %+v", err, role)
 				return []error{err}
 			}
 		}
 
 		for _, p := range role.Profiles {
-			_, err := p.Update(args.SiteID, role.Id)
+			err := args.Target.AddRoleProfile(args.SiteID, role.Id, &p)
 			if err != nil {
 				glog.Error(err)
 				return []error{err}
 			}
 		}
 
-		tx, err := h.GetTransaction()
-		if err != nil {
-			glog.Error(err)
-			return []error{err}
-		}
-		defer tx.Rollback()
-
-		err = accounting.RecordImport(
-			tx,
+		err = args.Target.RecordImport(
 			args.OriginID,
 			args.ItemTypeID,
 			oldRoleId,
@@ -191,11 +207,7 @@ func importRoles(args conc.Args, gophers int) []error {
 			return []error{err}
 		}
 
-		err = tx.Commit()
-		if err != nil {
-			glog.Error(err)
-			return []error{err}
-		}
+		accounting.RecordOutcome(args.ItemTypeID, accounting.Created)
 
 		if glog.V(2) {
 			glog.Infof("Successfully imported role %d", oldRoleId)
@@ -212,7 +224,11 @@ func importRoles(args conc.Args, gophers int) []error {
 	//		If they have a single moderator, change the forum so that the single
 	//			moderator is the owner.
 	//		Read custom usergroups, define a list of all roles that are custom
-	oldForumIDs := files.GetIDs(h.ItemTypes[h.ItemTypeMicrocosm])
+	oldForumIDs, err := files.GetIDs(h.ItemTypes[h.ItemTypeMicrocosm])
+	if err != nil {
+		glog.Errorf("Failed to get forum IDs: %+v", err)
+		return []error{err}
+	}
 	bar = pb.StartNew(len(oldForumIDs))
 	for _, forumID := range oldForumIDs {
 		srcForum := src.Forum{}
@@ -226,11 +242,14 @@ func importRoles(args conc.Args, gophers int) []error {
 		}
 
 		// Get the new microcosmID
-		microcosmID := accounting.GetNewID(
+		microcosmID, err := accounting.GetNewID(
 			args.OriginID,
 			h.ItemTypes[h.ItemTypeMicrocosm],
 			forumID,
 		)
+		if err != nil {
+			return []error{err}
+		}
 		if microcosmID == 0 {
 			glog.Error(fmt.Errorf("Expected microcosm for %d", forumID))
 			return []error{fmt.Errorf("Expected microcosm for %d", forumID)}
@@ -283,20 +302,16 @@ func importRoles(args conc.Args, gophers int) []error {
 					continue
 				}
 
-				_, err := role.Insert(args.SiteID, args.SiteOwnerProfileID)
+				err := args.Target.CreateRole(
+					args.SiteID,
+					args.SiteOwnerProfileID,
+					&role,
+				)
 				if err != nil {
 					glog.Errorf("%s %+v", err, role)
 					return []error{err}
 				}
 
-				for _, c := range role.Criteria {
-					_, err := c.Insert(role.Id)
-					if err != nil {
-						glog.Error(err)
-						return []error{err}
-					}
-				}
-
 				if role.IsModerator && !foundModsRole {
 					foundModsRole = true
 					// Add the profiles declared as members, and keep track of them
@@ -304,7 +319,7 @@ func importRoles(args conc.Args, gophers int) []error {
 					modsAdded := make(map[int64]bool)
 					for _, p := range role.Profiles {
 						modsAdded[p.Id] = true
-						_, err := p.Update(args.SiteID, role.Id)
+						err := args.Target.AddRoleProfile(args.SiteID, role.Id, &p)
 						if err != nil {
 							glog.Error(err)
 							return []error{err}
@@ -313,18 +328,21 @@ func importRoles(args conc.Args, gophers int) []error {
 
 					// Add the moderators
 					for _, oldModID := range srcForum.Moderators {
-						modID := accounting.GetNewID(
+						modID, err := accounting.GetNewID(
 							args.OriginID,
 							h.ItemTypes[h.ItemTypeProfile],
 							oldModID.ID,
 						)
+						if err != nil {
+							return []error{err}
+						}
 						if modID == 0 {
 							continue
 						}
 						if _, ok := modsAdded[modID]; !ok {
 							rp := models.RoleProfileType{}
 							rp.Id = modID
-							_, err := rp.Update(args.SiteID, role.Id)
+							err := args.Target.AddRoleProfile(args.SiteID, role.Id, &rp)
 							if err != nil {
 								glog.Error(err)
 								return []error{err}
@@ -334,7 +352,7 @@ func importRoles(args conc.Args, gophers int) []error {
 				} else {
 					// Just add the profiles that were already declared as members
 					for _, p := range role.Profiles {
-						_, err := p.Update(args.SiteID, role.Id)
+						err := args.Target.AddRoleProfile(args.SiteID, role.Id, &p)
 						if err != nil {
 							glog.Error(err)
 							return []error{err}
@@ -363,24 +381,31 @@ func importRoles(args conc.Args, gophers int) []error {
 			modRole.Meta.Created = time.Now()
 			modRole.Meta.CreatedById = args.SiteOwnerProfileID
 
-			_, err := modRole.Insert(args.SiteID, args.SiteOwnerProfileID)
+			err := args.Target.CreateRole(
+				args.SiteID,
+				args.SiteOwnerProfileID,
+				&modRole,
+			)
 			if err != nil {
 				glog.Error(err)
 				return []error{err}
 			}
 
 			for _, oldModID := range srcForum.Moderators {
-				modID := accounting.GetNewID(
+				modID, err := accounting.GetNewID(
 					args.OriginID,
 					h.ItemTypes[h.ItemTypeProfile],
 					oldModID.ID,
 				)
+				if err != nil {
+					return []error{err}
+				}
 				if modID == 0 {
 					continue
 				}
 				rp := models.RoleProfileType{}
 				rp.Id = modID
-				_, err := rp.Update(args.SiteID, modRole.Id)
+				err = args.Target.AddRoleProfile(args.SiteID, modRole.Id, &rp)
 				if err != nil {
 					glog.Error(err)
 					return []error{err}
@@ -0,0 +1,72 @@
+package imp
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+// Rollback deletes everything that was created by an import origin, in the
+// reverse of the order in which it was imported so that nothing is deleted
+// whilst other items still depend upon it. Finally the origin itself is
+// removed.
+//
+// Each item type is removed in its own transaction, so a rollback that fails
+// part way through can be run again.
+func Rollback(originID int64) error {
+	itemTypes := registry.All()
+	for i := len(itemTypes) - 1; i >= 0; i-- {
+		itemType := itemTypes[i].Name
+
+		fmt.Printf("Removing imported %s items...\n", itemType)
+		glog.Infof("Removing imported %s items...", itemType)
+
+		removed, err := rollbackItemType(originID, itemType)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %s items: %+v", itemType, err)
+		}
+
+		fmt.Printf("Removed %d %s items\n", removed, itemType)
+		glog.Infof("Removed %d %s items", removed, itemType)
+	}
+
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.DeleteImportOrigin(tx, originID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rollbackItemType removes the items of a single item type that were created by
+// the import origin, returning how many were recorded as imported
+func rollbackItemType(originID int64, itemType string) (int64, error) {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	removed, err := accounting.RollbackImports(
+		tx,
+		originID,
+		h.ItemTypes[itemType],
+		itemType,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, tx.Commit()
+}
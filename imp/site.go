@@ -11,6 +11,7 @@ import (
 
 	"github.com/microcosm-cc/import-schemas/accounting"
 	"github.com/microcosm-cc/import-schemas/config"
+	"github.com/microcosm-cc/import-schemas/files"
 )
 
 // Site struct
@@ -30,6 +31,7 @@ type Site struct {
 // createSiteAndAdminUser will either create or fetch the admin user and site
 func createSiteAndAdminUser(
 	owner src.Profile,
+	manifest files.Manifest,
 ) (
 	originID int64,
 	siteID int64,
@@ -96,14 +98,15 @@ func createSiteAndAdminUser(
 	}
 	defer tx2.Rollback()
 
-	originID = GetImportInProgress(siteID, config.SiteName)
+	originID = GetImportInProgress(siteID, config.Source)
 	if originID == 0 {
 		fmt.Println("Commencing import")
 		// Create an import origin.
 		originID, err = accounting.CreateImportOrigin(
 			tx2,
-			config.SiteName,
+			config.Source,
 			siteID,
+			manifest,
 		)
 		if err != nil {
 			glog.Fatal(err)
@@ -112,6 +115,7 @@ func createSiteAndAdminUser(
 	} else {
 		fmt.Println("Resuming import")
 		accounting.LoadPriorImports(originID)
+		accounting.LoadInterrupted(originID)
 	}
 
 	if siteCreatedByUs {
@@ -133,6 +137,18 @@ func createSiteAndAdminUser(
 		glog.Fatal(err)
 	}
 
+	if siteCreatedByUs {
+		err = accounting.RecordImportInMemory(
+			originID,
+			h.ItemTypes[h.ItemTypeProfile],
+			owner.ID,
+			adminID,
+		)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
 	// Finalise the site creation and import initialisation
 	return originID, siteID, adminID
 }
@@ -171,7 +187,8 @@ SELECT site_id
 	return
 }
 
-// GetImportInProgress looks up the site in the import_origins table
+// GetImportInProgress looks up the import of the source into the site in the
+// import_origins table
 func GetImportInProgress(
 	siteID int64,
 	originTitle string,
@@ -186,8 +203,10 @@ func GetImportInProgress(
 	err = db.QueryRow(`
 SELECT origin_id
   FROM import_origins
- WHERE site_id = $1`,
+ WHERE site_id = $1
+   AND title = $2`,
 		siteID,
+		originTitle,
 	).Scan(
 		&originID,
 	)
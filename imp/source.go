@@ -0,0 +1,40 @@
+package imp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/microcosm-cc/import-schemas/files"
+)
+
+// supportedSources are the products and versions that exports have been
+// imported from successfully. Others may work, but have not been tried.
+var supportedSources = []files.Manifest{
+	{Product: "vbulletin", MajorVersion: 3, MinorVersion: 8},
+}
+
+// checkSource returns an error if the export came from a product or version
+// that is not supported. When allowUnsupported is true a warning is logged
+// instead.
+func checkSource(manifest files.Manifest, allowUnsupported bool) error {
+	for _, supported := range supportedSources {
+		if strings.EqualFold(manifest.Product, supported.Product) &&
+			manifest.MajorVersion == supported.MajorVersion &&
+			manifest.MinorVersion == supported.MinorVersion {
+
+			return nil
+		}
+	}
+
+	err := fmt.Errorf("Export is from unsupported source %s", manifest)
+	if !allowUnsupported {
+		return err
+	}
+
+	fmt.Printf("Warning: %s\n", err)
+	glog.Warning(err)
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package imp
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+	"github.com/microcosm-cc/import-schemas/config"
+	"github.com/microcosm-cc/import-schemas/files"
+)
+
+// Status writes to w a summary of how far the import into the configured site
+// has progressed. For each phase the number of items recorded as imported is
+// compared with the number of items in the export.
+func Status(rootPath string, w io.Writer) error {
+	siteID, _ := GetExistingSiteAndAdmin(config.SiteSubdomainKey)
+	if siteID == 0 {
+		fmt.Fprintf(w, "Site %s does not exist\n", config.SiteSubdomainKey)
+		return nil
+	}
+
+	originID := GetImportInProgress(siteID, config.Source)
+	if originID == 0 {
+		fmt.Fprintf(
+			w,
+			"No import of %s into site %d has been started\n",
+			config.Source,
+			siteID,
+		)
+		return nil
+	}
+
+	counts, err := accounting.CountImportedItems(originID)
+	if err != nil {
+		return err
+	}
+
+	importedFollows, threadedComments, err := accounting.GetImportFlags(originID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Site: %d\nOrigin: %d\n\n", siteID, originID)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Phase\tExported\tDone\tRemaining\tDone %\t")
+
+	for _, p := range phases {
+		// Nothing is imported by phases without an item type
+		if p.ItemType == "" {
+			continue
+		}
+		itemTypeID := h.ItemTypes[p.ItemType]
+
+		var exported int64
+		if files.ExportExists(rootPath, itemTypeID) {
+			exported, err = files.CountIDs(rootPath, itemTypeID)
+			if err != nil {
+				return err
+			}
+		}
+
+		done := counts[itemTypeID]
+
+		// Profiles that share an email address are merged, and the site owner
+		// may have been recorded without being in the export, so done may
+		// exceed what was exported
+		remaining := exported - done
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		percent := float64(100)
+		if exported > 0 {
+			percent = float64(exported-remaining) / float64(exported) * 100
+		}
+
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%d\t%d\t%.1f\t\n",
+			p.Name,
+			exported,
+			done,
+			remaining,
+			percent,
+		)
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(
+		w,
+		"\nComments threaded: %t\nFollows imported: %t\n",
+		threadedComments,
+		importedFollows,
+	)
+
+	return nil
+}
@@ -0,0 +1,430 @@
+package imp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/files"
+	"github.com/microcosm-cc/import-schemas/registry"
+)
+
+// finding describes a single problem discovered in an export
+type finding struct {
+	ItemType string `json:"itemType"`
+	OldID    int64  `json:"oldId"`
+	Path     string `json:"path"`
+	Reason   string `json:"reason"`
+}
+
+// validator holds what is known about the export whilst it is validated
+type validator struct {
+	enc      *json.Encoder
+	findings int
+
+	// ids[itemTypeID] = sorted IDs of every item of that type in the export.
+	// Only the IDs are held, the paths are derived from them.
+	ids map[int64][]int64
+
+	// convs[i] = the conversation of the comment ids[comment][i], once known,
+	// so that the comment replied to is read at most once
+	convs []int64
+}
+
+// Validate streams every subtree of the export at rootPath and checks the
+// referential integrity of the items within it. Each problem found is written
+// to w as a single line of JSON, and the number of problems is returned.
+func Validate(rootPath string, w io.Writer) (int, error) {
+	v := validator{
+		enc: json.NewEncoder(w),
+		ids: make(map[int64][]int64),
+	}
+
+	// Discover everything first, so that references can be checked regardless
+	// of the order in which items are read.
+	for _, it := range registry.All() {
+		itemType, itemTypeID := it.Name, it.ID
+		if !files.ExportExists(rootPath, itemTypeID) {
+			glog.Infof("Export does not contain any %s items", itemType)
+			continue
+		}
+
+		ids, err := streamIDSet(rootPath, itemTypeID)
+		if err != nil {
+			return v.findings, err
+		}
+		v.ids[itemTypeID] = ids
+	}
+	v.convs = make([]int64, len(v.ids[h.ItemTypes[h.ItemTypeComment]]))
+
+	for _, it := range registry.All() {
+		itemType, itemTypeID := it.Name, it.ID
+
+		glog.Infof("Validating %d %s items", len(v.ids[itemTypeID]), itemType)
+
+		var err error
+		switch itemType {
+		case h.ItemTypeProfile:
+			err = v.validateProfiles()
+		case h.ItemTypeMicrocosm:
+			err = v.validateItems(itemTypeID, v.validateForum)
+		case h.ItemTypeConversation:
+			err = v.validateItems(itemTypeID, v.validateConversation)
+		case h.ItemTypeComment:
+			err = v.validateItems(itemTypeID, v.validateComment)
+		case h.ItemTypeHuddle:
+			err = v.validateItems(itemTypeID, v.validateMessage)
+		case h.ItemTypeAttachment:
+			err = v.validateItems(itemTypeID, v.validateAttachment)
+		case h.ItemTypeWatcher:
+			err = v.validateItems(itemTypeID, v.validateFollow)
+		case h.ItemTypeRole:
+			err = v.validateItems(itemTypeID, v.validateRole)
+		}
+		if err != nil {
+			return v.findings, err
+		}
+	}
+
+	return v.findings, nil
+}
+
+// streamIDSet returns the IDs of every item of a type in the export, sorted in
+// ascending order. The IDs are streamed rather than walked so that the paths of
+// the items are not held in memory.
+func streamIDSet(rootPath string, itemTypeID int64) ([]int64, error) {
+	count, err := files.CountIDs(rootPath, itemTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, count)
+
+	stream := make(chan int64)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- files.StreamIDs(context.Background(), rootPath, itemTypeID, stream)
+		close(stream)
+	}()
+	for id := range stream {
+		ids = append(ids, id)
+	}
+
+	err = <-errc
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// report writes a finding for the given item
+func (v *validator) report(
+	itemTypeID int64,
+	oldID int64,
+	reason string,
+	a ...interface{},
+) error {
+	v.findings++
+
+	return v.enc.Encode(finding{
+		ItemType: registry.Name(itemTypeID),
+		OldID:    oldID,
+		Path:     files.GetPath(itemTypeID, oldID),
+		Reason:   fmt.Sprintf(reason, a...),
+	})
+}
+
+// exists reports whether an item of the given type is in the export
+func (v *validator) exists(itemTypeID int64, oldID int64) bool {
+	_, ok := v.index(itemTypeID, oldID)
+	return ok
+}
+
+// index returns the position of an item within the IDs of its type
+func (v *validator) index(itemTypeID int64, oldID int64) (int, bool) {
+	ids := v.ids[itemTypeID]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= oldID })
+
+	return i, i < len(ids) && ids[i] == oldID
+}
+
+// validateItems reads every item of a type and passes it to check. Items that
+// cannot be read are reported rather than stopping the validation.
+func (v *validator) validateItems(
+	itemTypeID int64,
+	check func(itemTypeID int64, path string) (string, error),
+) error {
+	for _, oldID := range v.ids[itemTypeID] {
+		reason, err := check(itemTypeID, files.GetPath(itemTypeID, oldID))
+		if err != nil {
+			reason = fmt.Sprintf("could not be read: %+v", err)
+		}
+		if reason == "" {
+			continue
+		}
+
+		err = v.report(itemTypeID, oldID, "%s", reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateProfiles reports profiles that share an email address with a profile
+// that has a lower ID, as the import merges those into a single profile.
+func (v *validator) validateProfiles() error {
+	itemTypeID := h.ItemTypes[h.ItemTypeProfile]
+
+	emails := make(map[string]int64)
+	for _, oldID := range v.ids[itemTypeID] {
+		sp := src.Profile{}
+		err := files.JSONFileToInterface(files.GetPath(itemTypeID, oldID), &sp)
+		if err != nil {
+			err = v.report(itemTypeID, oldID, "could not be read: %+v", err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		email := strings.ToLower(sp.Email)
+		if email == "" {
+			continue
+		}
+		if firstID, ok := emails[email]; ok {
+			err = v.report(
+				itemTypeID,
+				oldID,
+				"email address %s is also used by profile %d",
+				email,
+				firstID,
+			)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		emails[email] = oldID
+	}
+
+	return nil
+}
+
+func (v *validator) validateForum(itemTypeID int64, path string) (string, error) {
+	f := forum{}
+	err := files.JSONFileToInterface(path, &f)
+	if err != nil {
+		return "", err
+	}
+
+	if f.ParentID > 0 && !v.exists(itemTypeID, f.ParentID) {
+		return fmt.Sprintf("parent forum %d does not exist", f.ParentID), nil
+	}
+
+	return "", nil
+}
+
+func (v *validator) validateConversation(
+	itemTypeID int64,
+	path string,
+) (
+	string,
+	error,
+) {
+	sc := src.Conversation{}
+	err := files.JSONFileToInterface(path, &sc)
+	if err != nil {
+		return "", err
+	}
+
+	if !v.exists(h.ItemTypes[h.ItemTypeMicrocosm], sc.ForumID) {
+		return fmt.Sprintf("forum %d does not exist", sc.ForumID), nil
+	}
+
+	return "", nil
+}
+
+func (v *validator) validateComment(
+	itemTypeID int64,
+	path string,
+) (
+	string,
+	error,
+) {
+	sc := src.Comment{}
+	err := files.JSONFileToInterface(path, &sc)
+	if err != nil {
+		return "", err
+	}
+
+	if i, ok := v.index(itemTypeID, sc.ID); ok {
+		v.convs[i] = sc.Association.OnID
+	}
+
+	if len(sc.Versions) == 0 {
+		return "comment has no versions", nil
+	}
+
+	if !v.exists(h.ItemTypes[h.ItemTypeConversation], sc.Association.OnID) {
+		return fmt.Sprintf(
+			"conversation %d does not exist",
+			sc.Association.OnID,
+		), nil
+	}
+
+	if sc.InReplyTo == 0 {
+		return "", nil
+	}
+
+	if !v.exists(itemTypeID, sc.InReplyTo) {
+		return fmt.Sprintf(
+			"in reply to comment %d which does not exist",
+			sc.InReplyTo,
+		), nil
+	}
+
+	// Replies usually follow the comment they reply to, whose conversation is
+	// then already known
+	i, _ := v.index(itemTypeID, sc.InReplyTo)
+	if v.convs[i] == 0 {
+		reply := src.Comment{}
+		err = files.JSONFileToInterface(
+			files.GetPath(itemTypeID, sc.InReplyTo),
+			&reply,
+		)
+		if err != nil {
+			// Reported when the comment itself is validated
+			return "", nil
+		}
+		v.convs[i] = reply.Association.OnID
+	}
+
+	if v.convs[i] != sc.Association.OnID {
+		return fmt.Sprintf(
+			"in reply to comment %d which is in conversation %d",
+			sc.InReplyTo,
+			v.convs[i],
+		), nil
+	}
+
+	return "", nil
+}
+
+func (v *validator) validateMessage(
+	itemTypeID int64,
+	path string,
+) (
+	string,
+	error,
+) {
+	sm := src.Message{}
+	err := files.JSONFileToInterface(path, &sm)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sm.Versions) == 0 {
+		return "message has no versions", nil
+	}
+
+	return "", nil
+}
+
+func (v *validator) validateAttachment(
+	itemTypeID int64,
+	path string,
+) (
+	string,
+	error,
+) {
+	sa := src.Attachment{}
+	err := files.JSONFileToInterface(path, &sa)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sa.Associations) == 0 {
+		return "attachment has no associations", nil
+	}
+
+	for _, assoc := range sa.Associations {
+		var assocItemTypeID int64
+		switch assoc.OnType {
+		case "comment":
+			assocItemTypeID = h.ItemTypes[h.ItemTypeComment]
+		case "profile":
+			assocItemTypeID = h.ItemTypes[h.ItemTypeProfile]
+		default:
+			return fmt.Sprintf("unknown association %s", assoc.OnType), nil
+		}
+
+		if !v.exists(assocItemTypeID, assoc.OnID) {
+			return fmt.Sprintf(
+				"attached to %s %d which does not exist",
+				assoc.OnType,
+				assoc.OnID,
+			), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (v *validator) validateFollow(
+	itemTypeID int64,
+	path string,
+) (
+	string,
+	error,
+) {
+	sf := src.Follow{}
+	err := files.JSONFileToInterface(path, &sf)
+	if err != nil {
+		return "", err
+	}
+
+	profileTypeID := h.ItemTypes[h.ItemTypeProfile]
+	if !v.exists(profileTypeID, sf.Author) {
+		return fmt.Sprintf("follower %d does not exist", sf.Author), nil
+	}
+
+	for _, user := range sf.Users {
+		if !v.exists(profileTypeID, user.ID) {
+			return fmt.Sprintf("followed user %d does not exist", user.ID), nil
+		}
+	}
+
+	for _, forum := range sf.Forums {
+		if !v.exists(h.ItemTypes[h.ItemTypeMicrocosm], forum.ID) {
+			return fmt.Sprintf("followed forum %d does not exist", forum.ID), nil
+		}
+	}
+
+	for _, conv := range sf.Conversations {
+		if !v.exists(h.ItemTypes[h.ItemTypeConversation], conv.ID) {
+			return fmt.Sprintf(
+				"followed conversation %d does not exist",
+				conv.ID,
+			), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (v *validator) validateRole(itemTypeID int64, path string) (string, error) {
+	return "", files.JSONFileToInterface(path, &src.Role{})
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
@@ -20,6 +22,41 @@ import (
 var memprof = flag.String("memprof", "", "write memory profile to file")
 var cpuprof = flag.String("cpuprof", "", "write cpu profile to file")
 var finalise = flag.Bool("finalise", false, "finalise the import")
+var dryRun = flag.Bool(
+	"dry-run",
+	false,
+	"validate the export and report on it without touching the database",
+)
+var continueOnError = flag.Bool(
+	"continue-on-error",
+	false,
+	"keep importing when an item fails, recording it in the failure ledger",
+)
+var gophers = flag.String(
+	"gophers",
+	"",
+	"override the gophers per item type (i.e. comment=10,attachment=100)",
+)
+var only = flag.String(
+	"only",
+	"",
+	"run only these phases (i.e. comments,attachments)",
+)
+var skip = flag.String(
+	"skip",
+	"",
+	"run every phase except these (i.e. huddles)",
+)
+var allowUnsupported = flag.Bool(
+	"allow-unsupported",
+	false,
+	"import an export from an unsupported product or version",
+)
+var retryFailures = flag.String(
+	"retry-failures",
+	"",
+	"import only the items of this type (i.e. comment) in the failure ledger",
+)
 
 func main() {
 	flag.Parse()
@@ -35,34 +72,12 @@ func main() {
 			glog.Fatal(err)
 		}
 
-		// Catch SIGINT and write heap profile
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT)
-		go func() {
-			for sig := range c {
-				glog.Warningf("Caught %v, stopping profiler and exiting..", sig)
-				// Heap profiler is run on GC, so make sure it GCs before exiting.
-				runtime.GC()
-				pprof.WriteHeapProfile(f)
-				f.Close()
-				glog.Flush()
-				os.Exit(1)
-			}
-		}()
-	} else {
-		// Catch closing signal and flush logs
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(
-			sigc,
-			syscall.SIGHUP,
-			syscall.SIGINT,
-			syscall.SIGTERM,
-			syscall.SIGQUIT,
-		)
-		go func() {
-			<-sigc
-			glog.Flush()
-			os.Exit(1)
+		// Write the heap profile when we exit
+		defer func() {
+			// Heap profiler is run on GC, so make sure it GCs before exiting.
+			runtime.GC()
+			pprof.WriteHeapProfile(f)
+			f.Close()
 		}()
 	}
 
@@ -75,24 +90,139 @@ func main() {
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
+	}
+
+	err := config.OverrideGophers(*gophers)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		// No command, so run the import
+
+	case "status":
+		// Summarises the progress of the import into the configured site
+		initDB()
 
-		// Catch closing signal and flush logs
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(
-			sigc,
-			syscall.SIGHUP,
-			syscall.SIGINT,
-			syscall.SIGTERM,
-			syscall.SIGQUIT,
+		err := imp.Status(config.Rootpath, os.Stdout)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		return
+
+	case "rollback":
+		// Removes everything created by an import origin
+		fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+		originID := fs.Int64("origin", 0, "the import origin to roll back")
+		fs.Parse(flag.Args()[1:])
+		if *originID == 0 {
+			glog.Fatal("rollback requires -origin")
+		}
+
+		initDB()
+
+		err := imp.Rollback(*originID)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		fmt.Printf("Rolled back import origin %d\n", *originID)
+		return
+
+	case "reconcile":
+		// Checks imported_items against the items it points at
+		fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		repair := fs.Bool(
+			"repair",
+			false,
+			"forget imports of items that no longer exist and queue them for retry",
 		)
-		go func() {
-			<-sigc
-			pprof.StopCPUProfile()
+		fs.Parse(flag.Args()[1:])
+
+		initDB()
+
+		findings, err := imp.Reconcile(config.Rootpath, *repair, os.Stdout)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if findings > 0 && !*repair {
 			glog.Flush()
 			os.Exit(1)
-		}()
+		}
+		return
+
+	case "validate":
+		// Checks the export without touching the database
+		findings, err := imp.Validate(config.Rootpath, os.Stdout)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if findings > 0 {
+			glog.Flush()
+			os.Exit(1)
+		}
+		return
+
+	default:
+		glog.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	if !*dryRun {
+		initDB()
+
+		// If you want to use memcache to help speed things up... the cache
+		// misses may not make this as fast as you hope though
+		cache.InitCache("localhost", 11211)
+	}
+
+	ctx := cancelOnSignal()
+
+	imp.Import(ctx, imp.Options{
+		Finalise:         *finalise,
+		DryRun:           *dryRun,
+		ContinueOnError:  *continueOnError,
+		RetryFailures:    *retryFailures,
+		Only:             *only,
+		Skip:             *skip,
+		AllowUnsupported: *allowUnsupported,
+	})
+
+	glog.Flush()
+
+	// An import that was stopped did not finish
+	if ctx.Err() != nil {
+		os.Exit(1)
 	}
+}
+
+// cancelOnSignal returns a context that is cancelled when a closing signal is
+// caught, so that the items of the import in progress are allowed to finish
+// and the import stops cleanly. A second signal exits immediately.
+func cancelOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(
+		sigc,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT,
+	)
+	go func() {
+		sig := <-sigc
+		glog.Warningf("Caught %v, finishing items in progress..", sig)
+		fmt.Println("Stopping once the items in progress have finished...")
+		cancel()
+
+		<-sigc
+		glog.Flush()
+		os.Exit(1)
+	}()
 
+	return ctx
+}
+
+func initDB() {
 	h.InitDBConnection(h.DBConfig{
 		Host:     config.DbHost,
 		Port:     config.DbPort,
@@ -101,9 +231,14 @@ func main() {
 		Password: config.DbPass,
 	})
 
-	// If you want to use memcache to help speed things up... the cache misses
-	// may not make this as fast as you hope though
-	cache.InitCache("localhost", 11211)
-
-	imp.Import(*finalise)
+	// The gophers are capped below the ceiling by gophersFor, so that there is
+	// always a connection free for a gopher that needs a second one and for
+	// the work that goes on alongside the gophers
+	if config.MaxConnections > 0 {
+		db, err := h.GetConnection()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		db.SetMaxOpenConns(int(config.MaxConnections))
+	}
 }
@@ -0,0 +1,94 @@
+package markup
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Some exports hold HTML rather than, or as well as, BBCode. The HTML that is
+// understood is rewritten as the equivalent BBCode so that there is only one
+// parser, and any other HTML tags are removed.
+//
+// Prose such as "if a <b and c> d" must not be mistaken for HTML, so only the
+// names of HTML elements are matched, and only when each of their attributes
+// is given a value.
+const (
+	htmlAttrs = `(\s+[a-z][a-z0-9_:-]*\s*=\s*("[^"]*"|'[^']*'|[^\s"'<>=` + "`" + `]+))*\s*`
+
+	htmlElements = `a|abbr|acronym|address|article|aside|audio|b|big|blockquote|` +
+		`body|br|button|caption|center|cite|code|col|colgroup|dd|del|dfn|` +
+		`div|dl|dt|em|embed|figcaption|figure|font|footer|form|h[1-6]|head|` +
+		`header|hr|html|i|iframe|img|input|ins|kbd|label|li|link|main|mark|` +
+		`meta|nav|noscript|object|ol|option|p|param|pre|q|s|samp|script|` +
+		`section|select|small|source|span|strike|strong|style|sub|sup|table|` +
+		`tbody|td|textarea|tfoot|th|thead|time|title|tr|tt|u|ul|var|video|wbr`
+)
+
+var (
+	htmlLineBreak = regexp.MustCompile(`(?i)<br` + htmlAttrs + `/?>`)
+	htmlParagraph = regexp.MustCompile(`(?i)</?(p|div)` + htmlAttrs + `>`)
+	htmlLink      = regexp.MustCompile(`(?i)<a\s[^<>]*href\s*=\s*["']([^"']*)["'][^<>]*>`)
+	htmlImage     = regexp.MustCompile(`(?i)<img\s[^<>]*src\s*=\s*["']([^"']*)["'][^<>]*>`)
+	htmlListItem  = regexp.MustCompile(`(?i)<li` + htmlAttrs + `>`)
+	htmlTag       = regexp.MustCompile(`(?i)</?(` + htmlElements + `)` + htmlAttrs + `/?>`)
+
+	// htmlSimple maps the HTML tags that have a BBCode equivalent
+	htmlSimple = map[string]string{
+		"b":          "b",
+		"strong":     "b",
+		"i":          "i",
+		"em":         "i",
+		"u":          "u",
+		"s":          "s",
+		"strike":     "s",
+		"del":        "s",
+		"blockquote": "quote",
+		"pre":        "code",
+		"code":       "code",
+		"ul":         "list",
+		"ol":         "list=1",
+	}
+	htmlSimpleTag = regexp.MustCompile(
+		`(?i)<(/?)(b|strong|i|em|u|s|strike|del|blockquote|pre|code|ul|ol)` +
+			htmlAttrs + `>`,
+	)
+)
+
+// verbatimRegion matches the tags whose contents are not parsed, and so whose
+// HTML is left alone
+var verbatimRegion = regexp.MustCompile(
+	`(?is)\[(code|html|php|noparse)(=[^\]]*)?\].*?\[/(code|html|php|noparse)\]`,
+)
+
+func htmlToBBCode(text string) string {
+	var out string
+	pos := 0
+	for _, loc := range verbatimRegion.FindAllStringIndex(text, -1) {
+		out += convertHTML(text[pos:loc[0]]) + text[loc[0]:loc[1]]
+		pos = loc[1]
+	}
+
+	return out + convertHTML(text[pos:])
+}
+
+func convertHTML(text string) string {
+	text = htmlLineBreak.ReplaceAllString(text, "\n")
+	text = htmlParagraph.ReplaceAllString(text, "\n\n")
+	text = htmlLink.ReplaceAllString(text, "[url=$1]")
+	text = strings.Replace(text, "</a>", "[/url]", -1)
+	text = strings.Replace(text, "</A>", "[/url]", -1)
+	text = htmlImage.ReplaceAllString(text, "[img]$1[/img]")
+	text = htmlListItem.ReplaceAllString(text, "[*]")
+
+	text = htmlSimpleTag.ReplaceAllStringFunc(text, func(tag string) string {
+		m := htmlSimpleTag.FindStringSubmatch(tag)
+		name := htmlSimple[strings.ToLower(m[2])]
+		if m[1] != "" {
+			// The closing tag has no argument, i.e. [/list] for [list=1]
+			return "[/" + strings.SplitN(name, "=", 2)[0] + "]"
+		}
+		return "[" + name + "]"
+	})
+
+	return htmlTag.ReplaceAllString(text, "")
+}
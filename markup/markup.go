@@ -0,0 +1,74 @@
+// Package markup converts the BBCode and HTML of exported comments and messages
+// into the Markdown that Microcosm expects.
+package markup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CommentLookup returns the ID of the comment that was imported for an old
+// post ID, or 0 if the post has not been imported
+type CommentLookup func(oldPostID int64) int64
+
+// Convert returns the Markdown for text that may contain BBCode and HTML.
+// Quotes that name the post they quote link to the comment that the post was
+// imported as when lookup finds it, lookup may be nil. Otherwise they link to
+// the post on the old forum at oldHostname, if it is not empty, so that the
+// links phase can rewrite the link once the post has been imported.
+//
+// Tags that are not opened and closed correctly are left as they were written.
+// Markdown within the text is escaped so that it is also shown as written,
+// other than within URLs so that they are still linked.
+func Convert(text string, lookup CommentLookup, oldHostname string) string {
+	c := converter{lookup: lookup, oldHostname: oldHostname}
+
+	md := c.render(parse(htmlToBBCode(normaliseNewlines(text))))
+
+	return strings.TrimSpace(tidyNewlines(md))
+}
+
+// converter holds what is needed whilst rendering a single text
+type converter struct {
+	lookup      CommentLookup
+	oldHostname string
+}
+
+// commentURL returns the URL of the comment imported for an old post ID. When
+// the post has not been imported yet it is the URL of the post on the old
+// forum, or an empty string if the old forum is not known.
+func (c converter) commentURL(oldPostID int64) string {
+	if oldPostID == 0 {
+		return ""
+	}
+
+	if c.lookup != nil {
+		if commentID := c.lookup(oldPostID); commentID > 0 {
+			return fmt.Sprintf("/comments/%d/", commentID)
+		}
+	}
+
+	if c.oldHostname == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("http://%s/showpost.php?p=%d", c.oldHostname, oldPostID)
+}
+
+var manyNewlines = regexp.MustCompile(`\n{3,}`)
+
+func normaliseNewlines(text string) string {
+	return strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\r", "\n", -1)
+}
+
+// tidyNewlines removes trailing whitespace from lines and reduces runs of blank
+// lines to a single blank line, as blocks each add blank lines around them
+func tidyNewlines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return manyNewlines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+}
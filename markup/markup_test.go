@@ -0,0 +1,59 @@
+package markup
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// lookup finds the comment imported for the post with the old ID 123 only, the
+// others link to the old forum
+func lookup(oldPostID int64) int64 {
+	if oldPostID == 123 {
+		return 456
+	}
+	return 0
+}
+
+// TestConvertGolden converts each testdata/*.bbcode file and compares the
+// Markdown with the .md file of the same name. Run with -update to rewrite the
+// .md files after checking the changes to them.
+func TestConvertGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.bbcode"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("No golden files found in testdata")
+	}
+
+	for _, input := range inputs {
+		text, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := Convert(string(text), lookup, "forum.example.com") + "\n"
+
+		golden := strings.TrimSuffix(input, ".bbcode") + ".md"
+		if *update {
+			err = ioutil.WriteFile(golden, []byte(got), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package markup
+
+import (
+	"regexp"
+	"strings"
+)
+
+// node is either text, when name is empty, or a tag and what it contains
+type node struct {
+	name     string
+	arg      string
+	text     string
+	children []*node
+
+	// open is the opening tag as it was written, so that it can be put back
+	// when the tag is never closed
+	open string
+}
+
+// The tags that are understood, anything else is treated as text
+var knownTags = map[string]bool{
+	"attach":     true,
+	"attachment": true,
+	"b":          true,
+	"center":     true,
+	"code":       true,
+	"color":      true,
+	"email":      true,
+	"font":       true,
+	"highlight":  true,
+	"html":       true,
+	"i":          true,
+	"img":        true,
+	"indent":     true,
+	"left":       true,
+	"list":       true,
+	"noparse":    true,
+	"php":        true,
+	"quote":      true,
+	"right":      true,
+	"s":          true,
+	"size":       true,
+	"strike":     true,
+	"sub":        true,
+	"sup":        true,
+	"u":          true,
+	"url":        true,
+	"video":      true,
+	"youtube":    true,
+	"*":          true,
+}
+
+// The contents of these tags are not parsed
+var verbatimTags = map[string]bool{
+	"code":    true,
+	"html":    true,
+	"noparse": true,
+	"php":     true,
+}
+
+var tagPattern = regexp.MustCompile(`\[(/?)([a-zA-Z]+|\*)(?:=([^\]\n]*))?\]`)
+
+// parse returns the tree of text and tags in the BBCode
+func parse(text string) []*node {
+	root := &node{}
+	stack := []*node{root}
+
+	top := func() *node {
+		return stack[len(stack)-1]
+	}
+	addText := func(s string) {
+		if s == "" {
+			return
+		}
+		children := top().children
+		if len(children) > 0 && children[len(children)-1].name == "" {
+			children[len(children)-1].text += s
+			return
+		}
+		top().children = append(top().children, &node{text: s})
+	}
+	// closeTo pops the stack down to and including the node at index i. Nodes
+	// above it were never closed and so are put back as text, other than list
+	// items which are closed by the end of their list.
+	closeTo := func(i int) {
+		for len(stack)-1 > i {
+			n := top()
+			stack = stack[:len(stack)-1]
+			if n.name != "*" {
+				unwind(top(), n)
+			}
+		}
+		stack = stack[:len(stack)-1]
+	}
+
+	pos := 0
+	for pos < len(text) {
+		loc := tagPattern.FindStringSubmatchIndex(text[pos:])
+		if loc == nil {
+			addText(text[pos:])
+			break
+		}
+
+		raw := text[pos+loc[0] : pos+loc[1]]
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(text[pos+loc[4] : pos+loc[5]])
+		var arg string
+		if loc[6] >= 0 {
+			arg = text[pos+loc[6] : pos+loc[7]]
+		}
+
+		addText(text[pos : pos+loc[0]])
+		pos += loc[1]
+
+		if !knownTags[name] {
+			addText(raw)
+			continue
+		}
+
+		if closing {
+			i := len(stack) - 1
+			for i > 0 && stack[i].name != name {
+				i--
+			}
+			if i == 0 {
+				addText(raw)
+				continue
+			}
+			closeTo(i)
+			continue
+		}
+
+		switch {
+		case verbatimTags[name]:
+			end := strings.Index(strings.ToLower(text[pos:]), "[/"+name+"]")
+			if end < 0 {
+				addText(raw)
+				continue
+			}
+			n := &node{name: name, arg: arg, open: raw, text: text[pos : pos+end]}
+			top().children = append(top().children, n)
+			pos += end + len("[/"+name+"]")
+
+		case name == "*":
+			// A list item is closed by the next item or the end of the list
+			if top().name == "*" {
+				closeTo(len(stack) - 1)
+			}
+			if top().name != "list" {
+				addText(raw)
+				continue
+			}
+			n := &node{name: name, open: raw}
+			top().children = append(top().children, n)
+			stack = append(stack, n)
+
+		default:
+			n := &node{name: name, arg: arg, open: raw}
+			top().children = append(top().children, n)
+			stack = append(stack, n)
+		}
+	}
+
+	// Anything still open was never closed
+	closeTo(0)
+
+	return root.children
+}
+
+// unwind replaces a tag that was never closed with its opening tag as text
+// followed by what it contains
+func unwind(parent *node, n *node) {
+	for i, child := range parent.children {
+		if child != n {
+			continue
+		}
+
+		replacement := append([]*node{{text: n.open}}, n.children...)
+		parent.children = append(
+			parent.children[:i],
+			append(replacement, parent.children[i+1:]...)...,
+		)
+		return
+	}
+}
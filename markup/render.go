@@ -0,0 +1,319 @@
+package markup
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// render returns the Markdown for the nodes
+func (c converter) render(nodes []*node) string {
+	var out string
+	for _, n := range nodes {
+		out += c.renderNode(n, out == "" || strings.HasSuffix(out, "\n"))
+	}
+
+	return out
+}
+
+// renderNode returns the Markdown for a node, lineStart being whether it
+// follows a newline or starts what it is within
+func (c converter) renderNode(n *node, lineStart bool) string {
+	switch n.name {
+	case "":
+		return escapeText(replaceSmilies(html.UnescapeString(n.text)), lineStart)
+
+	case "b":
+		return emphasise("**", c.render(n.children))
+
+	case "i":
+		return emphasise("*", c.render(n.children))
+
+	case "s", "strike":
+		return emphasise("~~", c.render(n.children))
+
+	case "url":
+		return c.renderURL(n)
+
+	case "email":
+		return c.renderEmail(n)
+
+	case "img":
+		src := strings.TrimSpace(plainText(n))
+		if src == "" {
+			return ""
+		}
+		return fmt.Sprintf("![](%s)", escapeURL(src))
+
+	case "quote":
+		return c.renderQuote(n)
+
+	case "code", "html", "php":
+		return "\n\n```\n" + strings.Trim(html.UnescapeString(n.text), "\n") +
+			"\n```\n\n"
+
+	case "noparse":
+		return escapeText(html.UnescapeString(n.text), lineStart)
+
+	case "list":
+		return c.renderList(n)
+
+	case "*":
+		// A list item outside of a list, when the list was never closed
+		return escapeText(n.open, lineStart) + c.render(n.children)
+
+	case "youtube", "video":
+		return renderVideo(n)
+
+	case "attach", "attachment":
+		// Attachments are imported separately and shown with the comment
+		return ""
+
+	default:
+		// Presentation that Markdown has no equivalent for, i.e. colour and
+		// size, keeps only what it contains
+		return c.render(n.children)
+	}
+}
+
+// emphasise wraps the text in the marker, which must be next to the text and
+// not whitespace for Markdown to treat it as emphasis
+func emphasise(marker string, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+func (c converter) renderURL(n *node) string {
+	href := strings.TrimSpace(n.arg)
+	if href == "" {
+		href = strings.TrimSpace(plainText(n))
+	}
+	href = strings.Trim(href, `"'`)
+	if href == "" {
+		return ""
+	}
+	if strings.HasPrefix(strings.ToLower(href), "www.") {
+		href = "http://" + href
+	}
+
+	// The URL is its own text rather than an autolink, so that the links
+	// phase can rewrite the URL without leaving the angle brackets around a
+	// relative URL
+	text := strings.TrimSpace(c.render(n.children))
+	if text == "" || text == href || n.arg == "" {
+		return fmt.Sprintf("[%s](%s)", escapeLinkText(href), escapeURL(href))
+	}
+
+	return fmt.Sprintf("[%s](%s)", text, escapeURL(href))
+}
+
+// emailAddress matches what looks like an email address, and nothing that
+// could be taken as another scheme, i.e. javascript:
+var emailAddress = regexp.MustCompile(
+	`^[^\s@<>()\[\]:;,"'\\]+@[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)+$`,
+)
+
+func (c converter) renderEmail(n *node) string {
+	address := strings.Trim(strings.TrimSpace(n.arg), `"'`)
+	if strings.HasPrefix(strings.ToLower(address), "mailto:") {
+		address = address[len("mailto:"):]
+	}
+	if address == "" {
+		address = strings.TrimSpace(plainText(n))
+	}
+
+	// Anything that is not an address keeps only its text
+	if !emailAddress.MatchString(address) {
+		return c.render(n.children)
+	}
+
+	text := strings.TrimSpace(c.render(n.children))
+	if text == "" {
+		text = escapeText(address, false)
+	}
+
+	return fmt.Sprintf("[%s](mailto:%s)", text, address)
+}
+
+// vBulletin quotes name the post as [quote=Name;123] or [quote=Name;n123], and
+// XenForo as [quote="Name, post: 123, member: 4"]
+var (
+	vbQuote = regexp.MustCompile(`^(.*);n?(\d+)$`)
+	xfQuote = regexp.MustCompile(`^(.*?),\s*post:\s*(\d+)`)
+)
+
+func (c converter) renderQuote(n *node) string {
+	name := strings.TrimSpace(html.UnescapeString(n.arg))
+	name = strings.Trim(name, `"'`)
+
+	var postID int64
+	for _, re := range []*regexp.Regexp{vbQuote, xfQuote} {
+		if m := re.FindStringSubmatch(name); m != nil {
+			name = strings.TrimSpace(m[1])
+			postID, _ = strconv.ParseInt(m[2], 10, 64)
+			break
+		}
+	}
+
+	body := strings.TrimSpace(tidyNewlines(c.render(n.children)))
+
+	var attribution string
+	if name != "" {
+		name = escapeText(name, false)
+		attribution = name + " wrote:"
+		if url := c.commentURL(postID); url != "" {
+			attribution = fmt.Sprintf("%s [wrote](%s):", name, url)
+		}
+		body = attribution + "\n\n" + body
+	}
+
+	return "\n\n" + prefixLines(body, "> ") + "\n\n"
+}
+
+func (c converter) renderList(n *node) string {
+	ordered := n.arg != ""
+
+	var out string
+	var count int
+	for _, child := range n.children {
+		if child.name != "*" {
+			// Text between the tags of a list, usually the newlines
+			if text := strings.TrimSpace(c.renderNode(child, true)); text != "" {
+				out += text + "\n"
+			}
+			continue
+		}
+
+		count++
+		marker := "* "
+		if ordered {
+			marker = strconv.Itoa(count) + ". "
+		}
+
+		item := strings.TrimSpace(tidyNewlines(c.render(child.children)))
+		out += marker + prefixLines(item, strings.Repeat(" ", len(marker)))[len(marker):] + "\n"
+	}
+
+	return "\n\n" + out + "\n"
+}
+
+var youtubeID = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+func renderVideo(n *node) string {
+	content := strings.TrimSpace(plainText(n))
+
+	// vBulletin 4 writes [video=youtube;ID]URL[/video]
+	if strings.HasPrefix(content, "http://") || strings.HasPrefix(content, "https://") {
+		return "<" + content + ">"
+	}
+
+	id := content
+	if parts := strings.SplitN(n.arg, ";", 2); len(parts) == 2 {
+		id = parts[1]
+	}
+	if youtubeID.MatchString(id) {
+		return "<https://www.youtube.com/watch?v=" + id + ">"
+	}
+
+	return content
+}
+
+// plainText returns the text within a tag without any markup
+func plainText(n *node) string {
+	if n.name == "" || verbatimTags[n.name] {
+		return html.UnescapeString(n.text)
+	}
+
+	var out string
+	for _, child := range n.children {
+		out += plainText(child)
+	}
+
+	return out
+}
+
+func prefixLines(text string, prefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = prefix + line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func escapeURL(url string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(url)
+}
+
+func escapeLinkText(text string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`).Replace(text)
+}
+
+var (
+	// inlineMarkup escapes the characters that are Markdown wherever they are
+	// written, i.e. the * of "5 * 4 * 3" that would otherwise be emphasis
+	inlineMarkup = strings.NewReplacer(
+		`\`, `\\`,
+		"`", "\\`",
+		"*", `\*`,
+		"_", `\_`,
+		"~", `\~`,
+		"[", `\[`,
+		"]", `\]`,
+	)
+
+	// htmlStart matches the < of what would be taken as HTML, i.e. the
+	// "<notatag>" of prose which would otherwise be removed as a tag
+	htmlStart = regexp.MustCompile(`<([a-zA-Z/!?])`)
+
+	// blockMarkup matches the characters that are Markdown at the start of a
+	// line, i.e. the heading of "#1 fan" or the list of "- nothing"
+	blockMarkup = regexp.MustCompile(`^([ \t]*)(#|>|[+-](?:\s|$)|-{2,}|=+[ \t]*$)`)
+
+	// orderedMarkup matches the number that starts an ordered list, i.e. the
+	// "1984. " of "1984. What a year"
+	orderedMarkup = regexp.MustCompile(`^([ \t]*\d+)\.(\s|$)`)
+
+	// bareURL matches the URLs in text, which are not escaped so that they are
+	// still linked and the links phase can rewrite them
+	bareURL = regexp.MustCompile(
+		`(?i)(?:\b[a-z][a-z0-9+.-]*://|\bwww\.)\S+|` +
+			`\b[a-z0-9-]+(?:\.[a-z0-9-]+)+/\S*`,
+	)
+)
+
+// escapeText escapes the Markdown in text so that it is shown as written. The
+// start of the text is only treated as the start of a line when lineStart is
+// true.
+func escapeText(text string, lineStart bool) string {
+	var out string
+	pos := 0
+	for _, loc := range bareURL.FindAllStringIndex(text, -1) {
+		out += escapeInline(text[pos:loc[0]]) + text[loc[0]:loc[1]]
+		pos = loc[1]
+	}
+	out += escapeInline(text[pos:])
+
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		if i == 0 && !lineStart {
+			continue
+		}
+		line = blockMarkup.ReplaceAllString(line, `$1\$2`)
+		lines[i] = orderedMarkup.ReplaceAllString(line, `$1\.$2`)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func escapeInline(text string) string {
+	return htmlStart.ReplaceAllString(inlineMarkup.Replace(text), `\<$1`)
+}
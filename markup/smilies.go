@@ -0,0 +1,62 @@
+package markup
+
+import (
+	"regexp"
+	"strings"
+)
+
+// smilies maps the default smilies of vBulletin to emoji, as Microcosm has no
+// images for them
+var smilies = map[string]string{
+	":)":         "🙂",
+	":-)":        "🙂",
+	":(":         "🙁",
+	":-(":        "🙁",
+	";)":         "😉",
+	";-)":        "😉",
+	":D":         "😀",
+	":-D":        "😀",
+	":p":         "😛",
+	":P":         "😛",
+	":o":         "😮",
+	":O":         "😮",
+	":cool:":     "😎",
+	":confused:": "😕",
+	":cry:":      "😢",
+	":eek:":      "😲",
+	":mad:":      "😠",
+	":rolleyes:": "🙄",
+	":redface:":  "😳",
+	":frown:":    "🙁",
+	":smile:":    "🙂",
+	":wink:":     "😉",
+	":biggrin:":  "😀",
+	":tongue:":   "😛",
+	":thumbsup:": "👍",
+}
+
+var word = regexp.MustCompile(`\S+`)
+
+// replaceSmilies replaces the smilies that stand alone as words, so that text
+// such as URLs is not changed. Trailing punctuation is allowed, i.e. "hi :)."
+func replaceSmilies(text string) string {
+	return word.ReplaceAllStringFunc(text, func(w string) string {
+		trimmed := strings.TrimRight(w, ".,!?")
+		if emoji, ok := smilies[trimmed]; ok {
+			return emoji + w[len(trimmed):]
+		}
+
+		// Named smilies are often written without spaces around them
+		if strings.Count(w, ":") >= 2 {
+			for code, emoji := range smilies {
+				if len(code) > 3 && strings.HasPrefix(code, ":") &&
+					strings.HasSuffix(code, ":") {
+
+					w = strings.Replace(w, code, emoji, -1)
+				}
+			}
+		}
+
+		return w
+	})
+}
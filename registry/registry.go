@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+	h "github.com/microcosm-cc/microcosm/helpers"
+)
+
+// ItemType is a type of item that can be imported. It knows where items of the
+// type are found within an export, the paths of the items that have been
+// discovered and the IDs of those that have been imported.
+type ItemType struct {
+	// ID is the Microcosm item type ID, i.e. h.ItemTypes[h.ItemTypeComment]
+	ID int64
+
+	// Name is the Microcosm item type name, i.e. h.ItemTypeComment
+	Name string
+
+	// ExportPath is the subdirectory of an export that contains the items,
+	// i.e. src.CommentsPath
+	ExportPath string
+
+	// paths[oldID] = path of the .json file of the item
+	paths     map[int64]string
+	pathsLock sync.Mutex
+
+	// ids maps the old IDs of imported items to their new IDs
+	ids     IDStore
+	idsLock sync.RWMutex
+}
+
+var (
+	// itemTypes[itemTypeID] = item type
+	itemTypes = make(map[int64]*ItemType)
+
+	// registered holds the item types in the order that they were registered,
+	// which is the order in which they are imported
+	registered []*ItemType
+)
+
+func init() {
+	// The order of these is the order in which they are imported, so that any
+	// dependencies are imported before they are needed
+	for _, it := range []struct {
+		name       string
+		exportPath string
+	}{
+		{h.ItemTypeProfile, src.ProfilesPath},
+		{h.ItemTypeMicrocosm, src.ForumsPath},
+		{h.ItemTypeConversation, src.ConversationsPath},
+		{h.ItemTypeComment, src.CommentsPath},
+		{h.ItemTypeHuddle, src.MessagesPath},
+		{h.ItemTypeAttachment, src.AttachmentsPath},
+		{h.ItemTypeWatcher, src.FollowsPath},
+		{h.ItemTypeRole, src.RolesPath},
+	} {
+		err := Register(it.name, it.exportPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register adds an item type that can be imported, the name being a Microcosm
+// item type name and exportPath the subdirectory of an export that contains
+// the items. Item types are imported in the order that they are registered.
+// It is not safe to call Register once an import has started.
+func Register(name string, exportPath string) error {
+	itemTypeID, ok := h.ItemTypes[name]
+	if !ok {
+		return fmt.Errorf("%s is not a Microcosm item type", name)
+	}
+	if _, ok := itemTypes[itemTypeID]; ok {
+		return fmt.Errorf("Item type %s is already registered", name)
+	}
+
+	it := &ItemType{
+		ID:         itemTypeID,
+		Name:       name,
+		ExportPath: exportPath,
+		paths:      make(map[int64]string),
+		ids:        NewMemoryStore(),
+	}
+	itemTypes[itemTypeID] = it
+	registered = append(registered, it)
+
+	return nil
+}
+
+// Get returns the item type for the item type ID, or an error if it has not
+// been registered
+func Get(itemTypeID int64) (*ItemType, error) {
+	it, ok := itemTypes[itemTypeID]
+	if !ok {
+		return nil, fmt.Errorf("Item type %d is not registered", itemTypeID)
+	}
+
+	return it, nil
+}
+
+// All returns every registered item type in the order that they are imported
+func All() []*ItemType {
+	return registered
+}
+
+// Name returns the name of the item type ID, or an empty string if it has not
+// been registered
+func Name(itemTypeID int64) string {
+	it, err := Get(itemTypeID)
+	if err != nil {
+		return ""
+	}
+
+	return it.Name
+}
+
+// AddPath records the path of the .json file of an item
+func (it *ItemType) AddPath(oldID int64, name string) {
+	it.pathsLock.Lock()
+	it.paths[oldID] = name
+	it.pathsLock.Unlock()
+}
+
+// Path returns the path recorded for an item
+func (it *ItemType) Path(oldID int64) (string, bool) {
+	it.pathsLock.Lock()
+	defer it.pathsLock.Unlock()
+
+	name, ok := it.paths[oldID]
+	return name, ok
+}
+
+// PathIDs returns the IDs of every item that a path has been recorded for,
+// sorted in ascending order
+func (it *ItemType) PathIDs() []int64 {
+	it.pathsLock.Lock()
+	keys := make([]int64, 0, len(it.paths))
+	for key := range it.paths {
+		keys = append(keys, key)
+	}
+	it.pathsLock.Unlock()
+
+	sort.Sort(int64Slice(keys))
+
+	return keys
+}
+
+// SetStore replaces where the old to new IDs of the item type are kept
+func (it *ItemType) SetStore(ids IDStore) {
+	it.idsLock.Lock()
+	it.ids = ids
+	it.idsLock.Unlock()
+}
+
+// Store returns where the old to new IDs of the item type are kept
+func (it *ItemType) Store() IDStore {
+	it.idsLock.RLock()
+	defer it.idsLock.RUnlock()
+
+	return it.ids
+}
+
+// SetID records the new ID of an item imported by the origin
+func (it *ItemType) SetID(originID int64, oldID int64, newID int64) {
+	it.idsLock.Lock()
+	it.ids.Set(originID, oldID, newID)
+	it.idsLock.Unlock()
+}
+
+// GetID returns the new ID of an item imported by the origin
+func (it *ItemType) GetID(originID int64, oldID int64) (int64, bool, error) {
+	it.idsLock.RLock()
+	defer it.idsLock.RUnlock()
+
+	return it.ids.Get(originID, oldID)
+}
+
+// CountIDs returns the number of items imported by the origin
+func (it *ItemType) CountIDs(originID int64) (int, error) {
+	it.idsLock.RLock()
+	defer it.idsLock.RUnlock()
+
+	return it.ids.Count(originID)
+}
+
+// int64Slice attaches the methods of sort.Interface to []int64, sorting in
+// increasing order
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,40 @@
+package registry
+
+// IDStore maps the old IDs of one item type to new IDs, separately for each
+// import origin as the old IDs of different origins overlap. Callers must not
+// call Set concurrently with any other method, but may call Get and Count
+// concurrently. A store that is not held in memory returns an error from Get
+// and Count when it cannot be read.
+type IDStore interface {
+	Set(originID int64, oldID int64, newID int64)
+	Get(originID int64, oldID int64) (int64, bool, error)
+	Count(originID int64) (int, error)
+}
+
+// MemoryStore is an IDStore held in memory, as store[originID][oldID] = newID.
+// Absence from this means that the item has not been imported by that origin.
+type MemoryStore map[int64]map[int64]int64
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() MemoryStore {
+	return make(MemoryStore)
+}
+
+// Set records the new ID of an item
+func (m MemoryStore) Set(originID int64, oldID int64, newID int64) {
+	if _, ok := m[originID]; !ok {
+		m[originID] = make(map[int64]int64)
+	}
+	m[originID][oldID] = newID
+}
+
+// Get returns the new ID of an item
+func (m MemoryStore) Get(originID int64, oldID int64) (int64, bool, error) {
+	newID, ok := m[originID][oldID]
+	return newID, ok, nil
+}
+
+// Count returns the number of items imported by the origin
+func (m MemoryStore) Count(originID int64) (int, error) {
+	return len(m[originID]), nil
+}
@@ -0,0 +1,308 @@
+package target
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+	"github.com/microcosm-cc/microcosm/models"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+)
+
+// PostgreSQL allows at most this many parameters in a statement
+const maxParams = 65535
+
+// The action_type_id of ips for an item being created
+const auditActionCreate = 1
+
+// CreateComments writes the comments with a statement per table rather than a
+// statement per comment. The IDs of the comments and revisions are taken from
+// their sequences first so that the rows of every table can be written without
+// waiting for the IDs of the rows that they depend on.
+//
+// The HTML of each revision is rendered by Microcosm, which stores it with a
+// statement per revision.
+//
+// The rows are those that CreateComment writes through the Import of the
+// comment and audit.Create: the comment, its revisions rendered and their links
+// stored by models.ProcessCommentMarkdown without sending updates, and the ips
+// row of its creation. Import does not maintain the comment counts, which are
+// recalculated once every comment has been imported. CreateComment ignores a
+// links_url_key error from storing the links, but here that aborts the
+// transaction of the batch, and the caller must then write the comments one at
+// a time with CreateComment.
+func (Microcosm) CreateComments(
+	siteID int64,
+	originID int64,
+	comments []*Comment,
+) error {
+
+	if len(comments) == 0 {
+		return nil
+	}
+
+	var revisionCount int
+	for _, c := range comments {
+		revisionCount += len(c.Revisions)
+	}
+
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	commentIDs, err := nextIDs(tx, "comments_comment_id_seq", len(comments))
+	if err != nil {
+		return err
+	}
+	revisionIDs, err := nextIDs(tx, "revisions_revision_id_seq", revisionCount)
+	if err != nil {
+		return err
+	}
+
+	var (
+		commentRows  [][]interface{}
+		revisionRows [][]interface{}
+		ipRows       [][]interface{}
+
+		oldIDs        []int64
+		replyIDs      []int64
+		oldInReplyTos []int64
+
+		// revisions[i][j] is the ID of comments[i].Revisions[j]
+		revisions [][]int64
+	)
+	for i, c := range comments {
+		m := &c.Comment
+		m.Id = commentIDs[i]
+		itemTypeID := h.ItemTypes[m.ItemType]
+
+		current := c.Revisions[len(c.Revisions)-1]
+
+		// Only comments that have been edited say who by
+		var edited, editedBy, editReason interface{}
+		if len(c.Revisions) > 1 {
+			edited = current.Created
+			editedBy = current.ProfileID
+			editReason = current.EditReason
+		}
+
+		commentRows = append(commentRows, []interface{}{
+			m.Id,
+			itemTypeID,
+			m.ItemId,
+			m.Meta.CreatedById,
+			m.Meta.Created,
+			m.Meta.Flags.Visible,
+			m.Meta.Flags.Moderated,
+			m.Meta.Flags.Deleted,
+			edited,
+			editedBy,
+			editReason,
+		})
+
+		revisions = append(revisions, revisionIDs[:len(c.Revisions)])
+		for j, r := range c.Revisions {
+			revisionID := revisionIDs[0]
+			revisionIDs = revisionIDs[1:]
+
+			isCurrent := j == len(c.Revisions)-1
+
+			revisionRows = append(revisionRows, []interface{}{
+				revisionID,
+				m.Id,
+				r.ProfileID,
+				r.Markdown,
+				"",
+				r.Created,
+				isCurrent,
+			})
+		}
+
+		if c.IP != nil {
+			ipRows = append(ipRows, []interface{}{
+				siteID,
+				itemTypeID,
+				m.Id,
+				auditActionCreate,
+				m.Meta.CreatedById,
+				m.Meta.Created,
+				c.IP.String(),
+			})
+		}
+
+		oldIDs = append(oldIDs, c.OldID)
+		if c.OldInReplyTo > 0 {
+			replyIDs = append(replyIDs, m.Id)
+			oldInReplyTos = append(oldInReplyTos, c.OldInReplyTo)
+		}
+	}
+
+	err = insertRows(
+		tx,
+		`INSERT INTO comments (
+	comment_id, item_type_id, item_id, profile_id, created, is_visible,
+	is_moderated, is_deleted, edited, edited_by, edit_reason
+) VALUES `,
+		commentRows,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertRows(
+		tx,
+		`INSERT INTO revisions (
+	revision_id, comment_id, profile_id, raw, html, created, is_current
+) VALUES `,
+		revisionRows,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertRows(
+		tx,
+		`INSERT INTO ips (
+	site_id, item_type_id, item_id, action_type_id, profile_id, seen,
+	ip_address
+) VALUES `,
+		ipRows,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = accounting.RecordImports(
+		tx,
+		originID,
+		h.ItemTypes[h.ItemTypeComment],
+		oldIDs,
+		commentIDs,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = accounting.RecordReplies(tx, originID, replyIDs, oldInReplyTos)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range comments {
+		m := &c.Comment
+		for j, r := range c.Revisions {
+			// The current revision is rendered from the text of the comment
+			markdown := r.Markdown
+			if j == len(c.Revisions)-1 {
+				markdown = m.Markdown
+			}
+
+			_, err = models.ProcessCommentMarkdown(
+				tx,
+				revisions[i][j],
+				markdown,
+				siteID,
+				h.ItemTypes[m.ItemType],
+				m.ItemId,
+				false,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// Only once committed are the comments known to have been imported
+	for _, c := range comments {
+		err = accounting.RecordImportInMemory(
+			originID,
+			h.ItemTypes[h.ItemTypeComment],
+			c.OldID,
+			c.Comment.Id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nextIDs takes n IDs from a sequence
+func nextIDs(tx *sql.Tx, sequence string, n int) ([]int64, error) {
+	ids := []int64{}
+	if n == 0 {
+		return ids, nil
+	}
+
+	rows, err := tx.Query(
+		`SELECT nextval('`+sequence+`') FROM generate_series(1, $1)`,
+		n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return ids, nil
+}
+
+// insertRows inserts the rows with as few statements as the limit on the
+// number of parameters of a statement allows. insert is the statement up to
+// and including VALUES.
+func insertRows(tx *sql.Tx, insert string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	perStatement := maxParams / len(rows[0])
+	for len(rows) > 0 {
+		n := perStatement
+		if n > len(rows) {
+			n = len(rows)
+		}
+
+		values := []string{}
+		params := []interface{}{}
+		for _, row := range rows[:n] {
+			placeholders := []string{}
+			for _, value := range row {
+				params = append(params, value)
+				placeholders = append(placeholders, fmt.Sprintf("$%d", len(params)))
+			}
+			values = append(values, "("+strings.Join(placeholders, ", ")+")")
+		}
+
+		_, err := tx.Exec(insert+strings.Join(values, ","), params...)
+		if err != nil {
+			return err
+		}
+
+		rows = rows[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package target
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+	h "github.com/microcosm-cc/microcosm/helpers"
+	"github.com/microcosm-cc/microcosm/models"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+)
+
+// Memory is a Target that writes nothing, it allocates IDs and remembers just
+// enough to behave like the Microcosm target. It is used for dry runs.
+type Memory struct {
+	// The last ID handed out, shared by all item types
+	lastID int64
+
+	// profiles[lowercase email] = profile, as profiles are unique per email
+	profiles     map[string]models.ProfileType
+	profilesLock sync.Mutex
+}
+
+// NewMemory returns an empty Memory target
+func NewMemory() *Memory {
+	return &Memory{
+		profiles: make(map[string]models.ProfileType),
+	}
+}
+
+// newID allocates an ID for a newly created item
+func (t *Memory) newID() int64 {
+	return atomic.AddInt64(&t.lastID, 1)
+}
+
+// CreateProfile returns the existing profile for the email address, or
+// creates one
+func (t *Memory) CreateProfile(
+	siteID int64,
+	sp src.Profile,
+) (
+	models.ProfileType,
+	bool,
+	error,
+) {
+	email := strings.ToLower(sp.Email)
+
+	t.profilesLock.Lock()
+	defer t.profilesLock.Unlock()
+
+	if p, ok := t.profiles[email]; ok {
+		return p, true, nil
+	}
+
+	p := models.ProfileType{}
+	p.Id = t.newID()
+	p.SiteId = siteID
+	p.ProfileName = sp.Name
+	p.Created = sp.DateCreated
+	p.LastActive = sp.LastActive
+	p.Visible = true
+
+	t.profiles[email] = p
+
+	return p, false, nil
+}
+
+// UpdateProfile does nothing
+func (t *Memory) UpdateProfile(profile *models.ProfileType) error {
+	return nil
+}
+
+// AuditProfile does nothing
+func (t *Memory) AuditProfile(siteID int64, profileID int64, sp src.Profile) {}
+
+// CreateMicrocosm allocates an ID for the microcosm
+func (t *Memory) CreateMicrocosm(m *models.MicrocosmType) error {
+	m.Id = t.newID()
+	return nil
+}
+
+// PlaceMicrocosm does nothing
+func (t *Memory) PlaceMicrocosm(
+	microcosmID int64,
+	parentID int64,
+	sequence int64,
+) error {
+	return nil
+}
+
+// FindMicrocosm returns 0 as a dry run has only the one origin, and so none of
+// the microcosms it created belong to another
+func (t *Memory) FindMicrocosm(
+	siteID int64,
+	originID int64,
+	title string,
+) (
+	int64,
+	error,
+) {
+	return 0, nil
+}
+
+// CreateConversation allocates an ID for the conversation
+func (t *Memory) CreateConversation(
+	siteID int64,
+	createdByID int64,
+	m *models.ConversationType,
+) error {
+	m.Id = t.newID()
+	return nil
+}
+
+// CreateComment allocates an ID for the comment
+func (t *Memory) CreateComment(
+	siteID int64,
+	m *models.CommentSummaryType,
+	ip net.IP,
+) error {
+	m.Id = t.newID()
+	return nil
+}
+
+// CreateHuddle allocates IDs for the huddle and its message
+func (t *Memory) CreateHuddle(
+	siteID int64,
+	huddle *models.HuddleType,
+	m *models.CommentSummaryType,
+	ip net.IP,
+) error {
+	huddle.Id = t.newID()
+	m.ItemId = huddle.Id
+	m.Id = t.newID()
+	return nil
+}
+
+// CreateComments allocates IDs for the comments and records their import in the
+// accounting maps
+func (t *Memory) CreateComments(
+	siteID int64,
+	originID int64,
+	comments []*Comment,
+) error {
+	for _, c := range comments {
+		c.Comment.Id = t.newID()
+
+		err := accounting.RecordImportInMemory(
+			originID,
+			h.ItemTypes[h.ItemTypeComment],
+			c.OldID,
+			c.Comment.Id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateRevisions does nothing
+func (t *Memory) CreateRevisions(
+	siteID int64,
+	commentID int64,
+	revisions []Revision,
+) error {
+
+	return nil
+}
+
+// CreateFileMetadata allocates an ID for the file
+func (t *Memory) CreateFileMetadata(fm *models.FileMetadataType) error {
+	fm.AttachmentMetaId = t.newID()
+	return nil
+}
+
+// CreateAttachment allocates an ID for the attachment
+func (t *Memory) CreateAttachment(at *models.AttachmentType) error {
+	at.AttachmentId = t.newID()
+	return nil
+}
+
+// CreateWatcher allocates an ID for the watcher
+func (t *Memory) CreateWatcher(w *models.WatcherType) error {
+	w.Id = t.newID()
+	return nil
+}
+
+// CreateRole allocates an ID for the role
+func (t *Memory) CreateRole(
+	siteID int64,
+	createdByID int64,
+	role *models.RoleType,
+) error {
+	role.Id = t.newID()
+	return nil
+}
+
+// AddRoleProfile does nothing
+func (t *Memory) AddRoleProfile(
+	siteID int64,
+	roleID int64,
+	rp *models.RoleProfileType,
+) error {
+	return nil
+}
+
+// RecordReply does nothing, as a dry run does not thread comments
+func (t *Memory) RecordReply(
+	originID int64,
+	commentID int64,
+	oldInReplyTo int64,
+) error {
+	return nil
+}
+
+// RecordExisting does nothing, as a dry run cannot be rolled back
+func (t *Memory) RecordExisting(itemTypeID int64, itemID int64) error {
+	return nil
+}
+
+// RecordImport records the import in the accounting maps only
+func (t *Memory) RecordImport(
+	originID int64,
+	itemTypeID int64,
+	oldID int64,
+	itemID int64,
+) error {
+	return accounting.RecordImportInMemory(originID, itemTypeID, oldID, itemID)
+}
+
+// RecordIntent does nothing, as a dry run cannot be resumed
+func (t *Memory) RecordIntent(
+	originID int64,
+	itemTypeID int64,
+	oldID int64,
+) error {
+	return nil
+}
+
+// RecordProfileIntent does nothing, as a dry run cannot be resumed or rolled
+// back
+func (t *Memory) RecordProfileIntent(
+	siteID int64,
+	originID int64,
+	sp src.Profile,
+) error {
+	return nil
+}
+
+// FindOrphan finds nothing, as a dry run cannot be resumed
+func (t *Memory) FindOrphan(o Orphan) (int64, error) {
+	return 0, nil
+}
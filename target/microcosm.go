@@ -0,0 +1,572 @@
+package target
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+	"github.com/microcosm-cc/microcosm/audit"
+	h "github.com/microcosm-cc/microcosm/helpers"
+	"github.com/microcosm-cc/microcosm/models"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+)
+
+// Microcosm is the Target that writes to a live Microcosm PostgreSQL database
+// via the microcosm models
+type Microcosm struct{}
+
+// CreateProfile puts a profile into the database via microcosm models
+func (Microcosm) CreateProfile(
+	siteID int64,
+	sp src.Profile,
+) (
+	models.ProfileType,
+	bool,
+	error,
+) {
+	u, status, err := models.GetUserByEmailAddress(sp.Email)
+	if err != nil && status != http.StatusNotFound {
+		glog.Errorf(
+			"Failed to get existing user by email address: <%s> %+v",
+			sp.Email,
+			err,
+		)
+		return models.ProfileType{}, false, err
+	}
+	if status == http.StatusNotFound {
+		glog.Infof("Creating new user for email address: %s", sp.Email)
+		// User doesn't exist, so we should create it
+		u = models.UserType{}
+		u.Email = sp.Email
+		u.Language = "en-GB"
+
+		_, err := u.Insert()
+		if err != nil {
+			glog.Errorf("Failed to create user for profile: %+v", err)
+			return models.ProfileType{}, false, err
+		}
+	} else {
+		// User does exist, so we should check whether that user already has a
+		// profile on this site and return that.
+		profileID, status, err := models.GetProfileId(siteID, u.ID)
+		if err != nil && status != http.StatusNotFound {
+			glog.Errorf("Failed to get existing profile for user: %+v", err)
+			return models.ProfileType{}, false, err
+		}
+		// If profile ID exists, fetch full profile and return. Otherwise,
+		// a new profile is created below.
+		if status == http.StatusOK {
+			profile, _, err := models.GetProfile(siteID, profileID)
+			if err != nil {
+				glog.Errorf("Failed to retrieve existing profile %d: %s", profileID, err)
+			}
+			return profile, true, nil
+		}
+	}
+
+	glog.Infof("Creating new profile: user: %d", u.ID)
+	// We don't have a profile, but we do now have a user, so create the profile
+	p := models.ProfileType{}
+	p.SiteId = siteID
+	p.UserId = u.ID
+	p.ProfileName = sp.Name
+	p.Created = sp.DateCreated
+	p.LastActive = sp.LastActive
+	p.Visible = true
+	p.StyleId = 1
+	p.AvatarUrlNullable = sql.NullString{
+		String: "/api/v1/files/66cca61feb8001cb71a9fb7062ff94c9d2543340",
+		Valid:  true,
+	}
+
+	_, err = p.Import()
+	if err != nil {
+		glog.Errorf("Failed to create profile for imported user %d: %+v", sp.ID, err)
+		return p, false, err
+	}
+
+	return p, false, nil
+}
+
+// RecordProfileIntent records the intent, and whether the profile existed
+// before the import, in its own transaction
+func (Microcosm) RecordProfileIntent(
+	siteID int64,
+	originID int64,
+	sp src.Profile,
+) error {
+	itemTypeID := h.ItemTypes[h.ItemTypeProfile]
+
+	profileID, err := findProfileID(siteID, sp.Email)
+	if err != nil {
+		return err
+	}
+
+	// A profile that an origin imported was created by that import
+	var existing bool
+	if profileID > 0 {
+		imported, err := accounting.IsImported(itemTypeID, profileID)
+		if err != nil {
+			glog.Errorf("Failed to check imports of profile %d: %+v", profileID, err)
+			return err
+		}
+		existing = !imported
+	}
+
+	tx, err := h.GetTransaction()
+	if err != nil {
+		glog.Errorf("Failed to get transaction: %+v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.RecordIntent(tx, originID, itemTypeID, sp.ID)
+	if err != nil {
+		glog.Errorf("Failed to record intent: %+v", err)
+		return err
+	}
+
+	if existing {
+		err = accounting.RecordExisting(tx, itemTypeID, profileID)
+		if err != nil {
+			glog.Errorf("Failed to record existing item: %+v", err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// findProfileID returns the ID of the profile on the site of the user with the
+// email address, or 0 if there is none
+func findProfileID(siteID int64, email string) (int64, error) {
+	u, status, err := models.GetUserByEmailAddress(email)
+	if status == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		glog.Errorf(
+			"Failed to get existing user by email address: <%s> %+v",
+			email,
+			err,
+		)
+		return 0, err
+	}
+
+	profileID, status, err := models.GetProfileId(siteID, u.ID)
+	if status == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		glog.Errorf("Failed to get existing profile for user: %+v", err)
+		return 0, err
+	}
+
+	return profileID, nil
+}
+
+// AuditProfile logs the IP address of the profile
+func (Microcosm) AuditProfile(siteID int64, profileID int64, sp src.Profile) {
+	audit.Create(
+		siteID,
+		h.ItemTypes[h.ItemTypeProfile],
+		profileID,
+		profileID,
+		sp.DateCreated,
+		net.ParseIP(sp.IPAddress),
+	)
+}
+
+// UpdateProfile saves the profile
+func (Microcosm) UpdateProfile(profile *models.ProfileType) error {
+	_, err := profile.Update()
+	return err
+}
+
+// CreateMicrocosm creates a microcosm
+func (Microcosm) CreateMicrocosm(m *models.MicrocosmType) error {
+	_, err := m.Import()
+	return err
+}
+
+// PlaceMicrocosm sets the parent and sequence of a microcosm
+func (Microcosm) PlaceMicrocosm(
+	microcosmID int64,
+	parentID int64,
+	sequence int64,
+) error {
+
+	db, err := h.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	// A top level microcosm has no parent
+	var parent interface{}
+	if parentID > 0 {
+		parent = parentID
+	}
+
+	_, err = db.Exec(`
+UPDATE microcosms
+   SET parent_id = $2
+      ,sequence = $3
+ WHERE microcosm_id = $1`,
+		microcosmID,
+		parent,
+		sequence,
+	)
+
+	return err
+}
+
+// FindMicrocosm finds a microcosm by title that another origin imported, or
+// that existed on the site before the import
+func (Microcosm) FindMicrocosm(
+	siteID int64,
+	originID int64,
+	title string,
+) (
+	int64,
+	error,
+) {
+	db, err := h.GetConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	var microcosmID int64
+	err = db.QueryRow(`
+SELECT m.microcosm_id
+  FROM microcosms m
+ WHERE m.site_id = $1
+   AND LOWER(m.title) = LOWER($2)
+   AND m.is_deleted IS NOT TRUE
+   AND NOT EXISTS (
+           SELECT 1
+             FROM imported_items i
+            WHERE i.origin_id = $3
+              AND i.item_type_id = $4
+              AND i.item_id = m.microcosm_id
+       )
+ ORDER BY m.microcosm_id
+ LIMIT 1`,
+		siteID,
+		title,
+		originID,
+		h.ItemTypes[h.ItemTypeMicrocosm],
+	).Scan(
+		&microcosmID,
+	)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return microcosmID, err
+}
+
+// CreateConversation creates a conversation
+func (Microcosm) CreateConversation(
+	siteID int64,
+	createdByID int64,
+	m *models.ConversationType,
+) error {
+	_, err := m.Import(siteID, createdByID)
+	return err
+}
+
+// CreateComment creates a comment and logs the IP address
+func (Microcosm) CreateComment(
+	siteID int64,
+	m *models.CommentSummaryType,
+	ip net.IP,
+) error {
+	// Import creates and commits/rollbacks its own transaction.
+	_, err := m.Import(siteID)
+	if err != nil {
+		// Ignore errors relating to link embedding.
+		if !strings.Contains(err.Error(), "links_url_key") {
+			return err
+		}
+	}
+
+	audit.Create(
+		siteID,
+		h.ItemTypes[h.ItemTypeComment],
+		m.Id,
+		m.Meta.CreatedById,
+		m.Meta.Created,
+		ip,
+	)
+
+	return nil
+}
+
+// CreateHuddle creates a huddle and its message, and logs the IP address
+func (Microcosm) CreateHuddle(
+	siteID int64,
+	huddle *models.HuddleType,
+	m *models.CommentSummaryType,
+	ip net.IP,
+) error {
+	_, err := huddle.Import(siteID)
+	if err != nil {
+		return err
+	}
+
+	m.ItemId = huddle.Id
+
+	_, err = m.Import(siteID)
+	if err != nil {
+		// Ignore errors relating to link embedding.
+		if !strings.Contains(err.Error(), "links_url_key") {
+			return err
+		}
+	}
+
+	audit.Create(
+		siteID,
+		h.ItemTypes[h.ItemTypeHuddle],
+		huddle.Id,
+		huddle.Meta.CreatedById,
+		huddle.Meta.Created,
+		ip,
+	)
+
+	return nil
+}
+
+// CreateRevisions adds the earlier revisions of a comment as revisions that are
+// not current, and makes the revision that the comment was created with that
+// of the last editor. Nothing is done when the comment already has earlier
+// revisions, as a comment adopted from an interrupted run may have them.
+func (Microcosm) CreateRevisions(
+	siteID int64,
+	commentID int64,
+	revisions []Revision,
+) error {
+
+	if len(revisions) < 2 {
+		return nil
+	}
+
+	tx, err := h.GetTransaction()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var earlier, itemTypeID, itemID int64
+	err = tx.QueryRow(`
+SELECT (SELECT COUNT(*)
+          FROM revisions
+         WHERE comment_id = c.comment_id
+           AND is_current IS NOT TRUE)
+      ,c.item_type_id
+      ,c.item_id
+  FROM comments c
+ WHERE c.comment_id = $1`,
+		commentID,
+	).Scan(
+		&earlier,
+		&itemTypeID,
+		&itemID,
+	)
+	if err != nil {
+		return err
+	}
+	if earlier > 0 {
+		return nil
+	}
+
+	current := revisions[len(revisions)-1]
+
+	_, err = tx.Exec(`
+UPDATE revisions
+   SET profile_id = $2
+      ,created = $3
+ WHERE comment_id = $1
+   AND is_current IS TRUE`,
+		commentID,
+		current.ProfileID,
+		current.Created,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range revisions[:len(revisions)-1] {
+		var revisionID int64
+		err = tx.QueryRow(`
+INSERT INTO revisions (
+	comment_id, profile_id, raw, html, created, is_current
+) VALUES (
+	$1, $2, $3, '', $4, FALSE
+) RETURNING revision_id`,
+			commentID,
+			r.ProfileID,
+			r.Markdown,
+			r.Created,
+		).Scan(
+			&revisionID,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = models.ProcessCommentMarkdown(
+			tx,
+			revisionID,
+			r.Markdown,
+			siteID,
+			itemTypeID,
+			itemID,
+			false,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+UPDATE comments
+   SET edited = $2
+      ,edited_by = $3
+      ,edit_reason = $4
+ WHERE comment_id = $1`,
+		commentID,
+		current.Created,
+		current.ProfileID,
+		current.EditReason,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateFileMetadata stores a file
+func (Microcosm) CreateFileMetadata(fm *models.FileMetadataType) error {
+	max := int64(1)<<32 - 1
+	_, err := fm.Import(max, max)
+	return err
+}
+
+// CreateAttachment attaches a file to an item
+func (Microcosm) CreateAttachment(at *models.AttachmentType) error {
+	_, err := at.Import()
+	return err
+}
+
+// CreateWatcher creates a watcher
+func (Microcosm) CreateWatcher(w *models.WatcherType) error {
+	_, err := w.Import()
+	return err
+}
+
+// CreateRole creates a role and its criteria
+func (Microcosm) CreateRole(
+	siteID int64,
+	createdByID int64,
+	role *models.RoleType,
+) error {
+	_, err := role.Insert(siteID, createdByID)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range role.Criteria {
+		_, err := c.Insert(role.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddRoleProfile makes the profile a member of the role
+func (Microcosm) AddRoleProfile(
+	siteID int64,
+	roleID int64,
+	rp *models.RoleProfileType,
+) error {
+	_, err := rp.Update(siteID, roleID)
+	return err
+}
+
+// RecordExisting records the existing item in its own transaction
+func (Microcosm) RecordExisting(itemTypeID int64, itemID int64) error {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		glog.Errorf("Failed to get transaction: %+v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.RecordExisting(tx, itemTypeID, itemID)
+	if err != nil {
+		glog.Errorf("Failed to record existing item: %+v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecordImport records the import in its own transaction, and only once that
+// has committed in the maps of old to new IDs
+func (Microcosm) RecordImport(
+	originID int64,
+	itemTypeID int64,
+	oldID int64,
+	itemID int64,
+) error {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		glog.Errorf("Failed to get transaction: %+v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.RecordImport(tx, originID, itemTypeID, oldID, itemID)
+	if err != nil {
+		glog.Errorf("Failed to recordImport: %+v", err)
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Errorf("Failed to commit transaction: %+v", err)
+		return err
+	}
+
+	return accounting.RecordImportInMemory(originID, itemTypeID, oldID, itemID)
+}
+
+// RecordReply records the reply in its own transaction
+func (Microcosm) RecordReply(
+	originID int64,
+	commentID int64,
+	oldInReplyTo int64,
+) error {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		glog.Errorf("Failed to get transaction: %+v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.RecordReply(tx, originID, commentID, oldInReplyTo)
+	if err != nil {
+		glog.Errorf("Failed to record reply: %+v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
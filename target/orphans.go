@@ -0,0 +1,169 @@
+package target
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+
+	h "github.com/microcosm-cc/microcosm/helpers"
+
+	"github.com/microcosm-cc/import-schemas/accounting"
+)
+
+// notImported returns a condition that the item ID in the column has not been
+// recorded as imported as an item of the item type by any origin
+func notImported(itemType string, column string) string {
+	return fmt.Sprintf(`
+   AND NOT EXISTS (
+           SELECT 1
+             FROM imported_items i
+            WHERE i.item_type_id = %d
+              AND i.item_id = %s
+       )`,
+		h.ItemTypes[itemType],
+		column,
+	)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// RecordIntent records the intent in its own transaction
+func (Microcosm) RecordIntent(
+	originID int64,
+	itemTypeID int64,
+	oldID int64,
+) error {
+	tx, err := h.GetTransaction()
+	if err != nil {
+		glog.Errorf("Failed to get transaction: %+v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	err = accounting.RecordIntent(tx, originID, itemTypeID, oldID)
+	if err != nil {
+		glog.Errorf("Failed to record intent: %+v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindOrphan finds the item that matches the orphan, taking the oldest should
+// several match
+func (Microcosm) FindOrphan(o Orphan) (int64, error) {
+	var (
+		query  string
+		params []interface{}
+	)
+	switch o.ItemTypeID {
+	case h.ItemTypes[h.ItemTypeMicrocosm]:
+		// The title may have been renamed to avoid another microcosm, i.e.
+		// "Title (source)", and the microcosm is only placed beneath its
+		// parent once it has been created
+		query = `
+SELECT m.microcosm_id
+  FROM microcosms m
+ WHERE m.site_id = $1
+   AND m.created_by = $2
+   AND m.created = $3
+   AND (m.title = $4 OR m.title LIKE $5)
+   AND (m.parent_id IS NULL OR m.parent_id = $6)` +
+			notImported(h.ItemTypeMicrocosm, "m.microcosm_id")
+		params = []interface{}{
+			o.SiteID,
+			o.CreatedByID,
+			o.Created,
+			o.Title,
+			likeEscaper.Replace(o.Title) + ` (%)`,
+			o.ParentID,
+		}
+
+	case h.ItemTypes[h.ItemTypeConversation]:
+		query = `
+SELECT c.conversation_id
+  FROM conversations c
+ WHERE c.microcosm_id = $1
+   AND c.title = $2
+   AND c.created_by = $3
+   AND c.created = $4` + notImported(h.ItemTypeConversation, "c.conversation_id")
+		params = []interface{}{o.ParentID, o.Title, o.CreatedByID, o.Created}
+
+	case h.ItemTypes[h.ItemTypeComment]:
+		query = `
+SELECT c.comment_id
+  FROM comments c
+ WHERE c.item_type_id = $1
+   AND c.item_id = $2
+   AND c.profile_id = $3
+   AND c.created = $4` + notImported(h.ItemTypeComment, "c.comment_id")
+		params = []interface{}{
+			o.ParentItemTypeID,
+			o.ParentID,
+			o.CreatedByID,
+			o.Created,
+		}
+
+	case h.ItemTypes[h.ItemTypeHuddle]:
+		query = `
+SELECT u.huddle_id
+  FROM huddles u
+ WHERE u.site_id = $1
+   AND u.title = $2
+   AND u.created_by = $3
+   AND u.created = $4` + notImported(h.ItemTypeHuddle, "u.huddle_id")
+		params = []interface{}{o.SiteID, o.Title, o.CreatedByID, o.Created}
+
+	case h.ItemTypes[h.ItemTypeAttachment]:
+		// Attachments are recorded by the ID of their file rather than their
+		// own ID, so any attachment of the file that matches is an orphan
+		query = `
+SELECT a.attachment_id
+  FROM attachments a
+ WHERE a.item_type_id = $1
+   AND a.item_id = $2
+   AND a.profile_id = $3
+   AND a.created = $4
+   AND a.attachment_meta_id = $5`
+		params = []interface{}{
+			o.ParentItemTypeID,
+			o.ParentID,
+			o.CreatedByID,
+			o.Created,
+			o.FileMetaID,
+		}
+
+	case h.ItemTypes[h.ItemTypeRole]:
+		query = `
+SELECT r.role_id
+  FROM roles r
+ WHERE r.site_id = $1
+   AND r.title = $2` + notImported(h.ItemTypeRole, "r.role_id")
+		params = []interface{}{o.SiteID, o.Title}
+
+	default:
+		return 0, fmt.Errorf("Cannot find orphans of item type %d", o.ItemTypeID)
+	}
+
+	db, err := h.GetConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	var itemID int64
+	err = db.QueryRow(query+`
+ ORDER BY 1
+ LIMIT 1`,
+		params...,
+	).Scan(
+		&itemID,
+	)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return itemID, err
+}
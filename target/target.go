@@ -0,0 +1,162 @@
+// Package target defines the destinations that an import can write to
+package target
+
+import (
+	"net"
+	"time"
+
+	src "github.com/microcosm-cc/export-schemas/go/forum"
+	"github.com/microcosm-cc/microcosm/models"
+)
+
+// Revision is a version of a comment
+type Revision struct {
+	// ProfileID is the profile that wrote this version
+	ProfileID int64
+
+	Markdown   string
+	Created    time.Time
+	EditReason string
+}
+
+// Comment is a comment to be created by CreateComments, with everything that
+// is recorded about its import
+type Comment struct {
+	OldID int64
+
+	// Comment is created with the text of the last revision
+	Comment   models.CommentSummaryType
+	Revisions []Revision
+
+	// IP is the address the comment was posted from, and may be nil
+	IP net.IP
+
+	// OldInReplyTo is the old ID of the comment that this replies to, or 0
+	OldInReplyTo int64
+}
+
+// Orphan describes an item that an interrupted run of the import may have
+// created without recording its import. Only the fields that identify an item
+// of its type need be set.
+type Orphan struct {
+	ItemTypeID int64
+	SiteID     int64
+
+	// ParentItemTypeID and ParentID are those of the item that the orphan
+	// belongs to, i.e. the conversation of a comment
+	ParentItemTypeID int64
+	ParentID         int64
+
+	Title       string
+	CreatedByID int64
+	Created     time.Time
+
+	// FileMetaID is the attachment_meta_id of the file of an attachment
+	FileMetaID int64
+}
+
+// Target is the destination of an import. The Create funcs are given a fully
+// populated model and will set the ID of the item that they create on it.
+type Target interface {
+	// CreateProfile returns the profile on the site for the email address of
+	// the exported profile, creating the user and profile if necessary, and
+	// whether the profile already existed
+	CreateProfile(
+		siteID int64,
+		sp src.Profile,
+	) (
+		models.ProfileType,
+		bool,
+		error,
+	)
+
+	// UpdateProfile saves changes to a profile returned by CreateProfile
+	UpdateProfile(profile *models.ProfileType) error
+
+	// RecordProfileIntent records the intent to create the profile of the
+	// exported profile, see RecordIntent. When the site already has a profile
+	// for its email address that no origin has imported, that profile is
+	// recorded as existing in the same transaction, see RecordExisting, so that
+	// a run interrupted once the profile is adopted still keeps it on rollback.
+	RecordProfileIntent(siteID int64, originID int64, sp src.Profile) error
+
+	// AuditProfile logs the IP address that the exported profile was created
+	// from against the imported profile
+	AuditProfile(siteID int64, profileID int64, sp src.Profile)
+
+	CreateMicrocosm(m *models.MicrocosmType) error
+
+	// PlaceMicrocosm nests a microcosm beneath the parent microcosm, or at the
+	// top level when parentID is 0, and sets its position amongst its siblings
+	PlaceMicrocosm(microcosmID int64, parentID int64, sequence int64) error
+
+	// FindMicrocosm returns the ID of a microcosm on the site with the given
+	// title that was not imported by the origin, or 0 if there is none
+	FindMicrocosm(siteID int64, originID int64, title string) (int64, error)
+
+	CreateConversation(
+		siteID int64,
+		createdByID int64,
+		m *models.ConversationType,
+	) error
+
+	// CreateComment creates the comment and logs the IP address it was posted
+	// from
+	CreateComment(siteID int64, m *models.CommentSummaryType, ip net.IP) error
+
+	// CreateHuddle creates the huddle and the comment that is its message, and
+	// logs the IP address it was sent from
+	CreateHuddle(
+		siteID int64,
+		huddle *models.HuddleType,
+		m *models.CommentSummaryType,
+		ip net.IP,
+	) error
+
+	// CreateComments creates the comments, their revisions and the logs of the
+	// IP addresses they were posted from, and records their import and replies,
+	// all in a single transaction. The ID of each is set on its Comment.
+	CreateComments(siteID int64, originID int64, comments []*Comment) error
+
+	// CreateRevisions replaces the revision history of a comment created by
+	// CreateComment or CreateHuddle with the given revisions, oldest first. The
+	// comment must have been created with the text of the last revision, which
+	// remains the current revision. The HTML of each earlier revision is
+	// rendered as it is for the current revision.
+	CreateRevisions(siteID int64, commentID int64, revisions []Revision) error
+
+	// CreateFileMetadata stores a file, it is idempotent and so may be called
+	// for a file that already exists
+	CreateFileMetadata(fm *models.FileMetadataType) error
+
+	// CreateAttachment attaches a file stored by CreateFileMetadata to an item
+	CreateAttachment(at *models.AttachmentType) error
+
+	CreateWatcher(w *models.WatcherType) error
+
+	// CreateRole creates the role and its criteria, but not its members
+	CreateRole(siteID int64, createdByID int64, role *models.RoleType) error
+
+	// AddRoleProfile makes the profile a member of a role
+	AddRoleProfile(siteID int64, roleID int64, rp *models.RoleProfileType) error
+
+	// RecordReply records that an imported comment replies to the comment with
+	// the old ID, see accounting.RecordReply
+	RecordReply(originID int64, commentID int64, oldInReplyTo int64) error
+
+	// RecordIntent records that an item is about to be created, see
+	// accounting.RecordIntent
+	RecordIntent(originID int64, itemTypeID int64, oldID int64) error
+
+	// FindOrphan returns the ID of an item matching the orphan that has not
+	// been recorded as imported, or 0 if there is none
+	FindOrphan(o Orphan) (int64, error)
+
+	// RecordExisting records that an item adopted by the import existed
+	// before it, see accounting.RecordExisting
+	RecordExisting(itemTypeID int64, itemID int64) error
+
+	// RecordImport records that an item has been imported, see
+	// accounting.RecordImport
+	RecordImport(originID int64, itemTypeID int64, oldID int64, itemID int64) error
+}